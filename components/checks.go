@@ -0,0 +1,447 @@
+/*
+Checks of whole clusters, the severity levels of check findings, and the one-line summaries that monitoring systems
+read.
+
+Womply, www.womply.com
+*/
+package components
+
+import str "strings"
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+)
+
+//
+// Severity is how serious a check finding is. The values are the exit codes Nagios plugins use, so a check can exit
+// with the severity of its worst finding.
+//
+type Severity int
+
+const (
+	SeverityOK       Severity = 0
+	SeverityWarning  Severity = 1
+	SeverityCritical Severity = 2
+	SeverityUnknown  Severity = 3 // The check itself couldn't be done, e.g. AWS couldn't be reached
+)
+
+func (severity Severity) String() string {
+	switch severity {
+	case SeverityOK:
+		return "OK"
+	case SeverityWarning:
+		return "WARNING"
+	case SeverityCritical:
+		return "CRITICAL"
+	}
+	return "UNKNOWN"
+}
+
+// MarshalText makes a severity show up by name in JSON output.
+func (severity Severity) MarshalText() ([]byte, error) {
+	return []byte(severity.String()), nil
+}
+
+//
+// CheckFinding is something a check found wrong, and how serious it is.
+//
+type CheckFinding struct {
+	Severity Severity `json:"severity"`
+	Message  string   `json:"message"`
+}
+
+//
+// CheckReport is the result of checking every service in one or more clusters. A service is healthy if its check is
+// OK, degraded if the worst finding is a WARNING and down if it's CRITICAL. Status is the worst of the services.
+//
+type CheckReport struct {
+	Clusters []string       `json:"clusters"`
+	Status   Severity       `json:"status"`
+	Summary  string         `json:"summary"`
+	Healthy  int            `json:"healthy"`
+	Degraded int            `json:"degraded"`
+	Down     int            `json:"down"`
+	Services []ServiceCheck `json:"services"`
+}
+
+//
+// Work out what the check operation was asked to check from the arguments that follow it: a cluster and service, a
+// cluster, or with all set every cluster. Returns the cluster names to give CheckClusters, which are nil for every
+// cluster, and the service name, which is empty unless one service is to be checked. -all or --all is accepted after
+// the operation as well as before it. Any other argument starting with a dash is a flag given too late, since flag
+// parsing stops at the operation, and is a ValidationError rather than being taken as a cluster name.
+//
+func ParseCheckArguments(args []string, all bool) ([]string, string, error) {
+	var names []string
+	for _, arg := range args {
+		switch {
+		case arg == "-all" || arg == "--all":
+			all = true
+		case str.HasPrefix(arg, "-"):
+			return nil, "", &ValidationError{Message: fmt.Sprintf("%s isn't a cluster or service name, flags must come before the operation", arg)}
+		default:
+			names = append(names, arg)
+		}
+	}
+	switch {
+	case all && len(names) > 0:
+		return nil, "", &ValidationError{Message: "can't give a cluster or service name to check with -all"}
+	case all:
+		return nil, "", nil
+	case len(names) == 0:
+		return nil, "", &ValidationError{Message: "must specify a cluster name, and optionally a service name, or -all to check"}
+	case len(names) > 2:
+		return nil, "", &ValidationError{Message: fmt.Sprintf("too many names to check: %s", str.Join(names, " "))}
+	case len(names) == 2:
+		return names[:1], names[1], nil
+	}
+	return names, "", nil
+}
+
+//
+// Check every service in the named clusters, or in all the clusters in the region if clusterNames is empty, the way
+// CheckService checks one. The services of all the clusters are checked together, up to concurrency at the same time,
+// and come back cluster by cluster in the order ECS describes them. Returns a NotFoundError if a named cluster doesn't
+// exist, or the first error from checking a service, since a report that leaves services out can't be trusted.
+//
+func CheckClusters(clients *Clients, clusterNames []string, concurrency int) (*CheckReport, error) {
+	awsConn := clients.ECS
+	var subject = str.Join(clusterNames, ",")
+	if len(clusterNames) == 0 {
+		clusterArns, err := listClusterArns(awsConn)
+		if err != nil {
+			return nil, err
+		}
+		for _, arn := range clusterArns {
+			clusterNames = append(clusterNames, (*arn)[str.LastIndex(*arn, "/")+1:])
+		}
+		subject = "all clusters"
+	}
+	if clusterNames == nil {
+		clusterNames = []string{} // No clusters in the region
+	}
+
+	// Describe the services of each cluster, then check them all at once.
+	var clusterServices = make([][]*ecs.Service, len(clusterNames))
+	err := forEachConcurrently(len(clusterNames), concurrency, func(index int) error {
+		serviceArns, err := listServiceArns(awsConn, clusterNames[index])
+		if err != nil {
+			return err
+		}
+		clusterServices[index], err = describeServices(awsConn, clusterNames[index], serviceArns)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var services []*ecs.Service
+	var serviceClusters []string
+	for index, described := range clusterServices {
+		for _, service := range described {
+			services = append(services, service)
+			serviceClusters = append(serviceClusters, clusterNames[index])
+		}
+	}
+	report := &CheckReport{
+		Clusters: clusterNames,
+		Services: make([]ServiceCheck, len(services)),
+	}
+	err = forEachConcurrently(len(services), concurrency, func(index int) error {
+		check, err := checkService(clients, serviceClusters[index], services[index])
+		if err != nil {
+			return err
+		}
+		report.Services[index] = *check
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var down, degraded []string
+	for _, check := range report.Services {
+		switch check.Status {
+		case SeverityOK:
+			report.Healthy++
+		case SeverityWarning:
+			report.Degraded++
+			degraded = append(degraded, check.Cluster+"/"+check.Service)
+		default:
+			report.Down++
+			down = append(down, check.Cluster+"/"+check.Service)
+		}
+		if check.Status > report.Status {
+			report.Status = check.Status
+		}
+	}
+	var detail = fmt.Sprintf("%d healthy, %d degraded, %d down", report.Healthy, report.Degraded, report.Down)
+	if len(down) > 0 {
+		detail += "; down: " + str.Join(down, ", ")
+	}
+	if len(degraded) > 0 {
+		detail += "; degraded: " + str.Join(degraded, ", ")
+	}
+	report.Summary = checkSummary(report.Status, subject, detail,
+		fmt.Sprintf("healthy=%d degraded=%d down=%d", report.Healthy, report.Degraded, report.Down))
+	return report, nil
+}
+
+//
+// Print the report from CheckClusters: the one-line summary, then a line for each service with its status. If
+// verboseFlag is set each service's findings, tasks and recently stopped tasks are printed under it too.
+//
+func PrintCheckReport(report *CheckReport, verboseFlag bool) {
+	fmt.Println(report.Summary)
+	for index := range report.Services {
+		check := &report.Services[index]
+		fmt.Printf("  %-8s %s/%s: %s\n", check.Status, check.Cluster, check.Service, check.detail())
+		if verboseFlag {
+			for _, finding := range check.Findings {
+				fmt.Printf("    %s: %s\n", finding.Severity, finding.Message)
+			}
+			printServiceTasks(check.Tasks)
+			if len(check.Stopped) > 0 {
+				PrintStoppedTasks(check.Stopped)
+			}
+		}
+	}
+}
+
+/////////////// Private functions
+
+// The most serious severity among the findings, or OK if there are none.
+func worstSeverity(findings []CheckFinding) Severity {
+	var worst = SeverityOK
+	for _, finding := range findings {
+		if finding.Severity > worst {
+			worst = finding.Severity
+		}
+	}
+	return worst
+}
+
+//
+// Make the one-line summary of a check in the form monitoring plugins print: the status, what was checked, a detail
+// such as the most serious findings, then performance data after a "|".
+//
+func checkSummary(status Severity, subject string, detail string, perfData string) string {
+	return fmt.Sprintf("ECS %s - %s: %s | %s", status, subject, detail, perfData)
+}
+
+//
+// Describe a list of findings in one line, the most serious first, or with the healthy text if there are none.
+// Findings with the same message, such as several tasks on the same old revision, are only mentioned once.
+//
+func checkDetail(findings []CheckFinding, healthy string) string {
+	var messages []string
+	var seen = map[string]bool{}
+	for severity := SeverityCritical; severity > SeverityOK; severity-- {
+		for _, finding := range findings {
+			if finding.Severity == severity && !seen[finding.Message] {
+				seen[finding.Message] = true
+				messages = append(messages, finding.Message)
+			}
+		}
+	}
+	if len(messages) == 0 {
+		return healthy
+	}
+	return str.Join(messages, "; ")
+}
+
+//
+// Compare the number of instances registered with the service's classic ELBs, and the number of targets registered
+// with each of its target groups, against the number of running tasks. Running tasks with nothing registered to send
+// them traffic is CRITICAL, any other difference a WARNING. Targets that are draining are on their way out, so they
+// aren't counted.
+//
+// Then look at the health of the instances and targets that belong to the service's running tasks. Each one that isn't
+// healthy is a WARNING, and a load balancer where none of them are healthy is CRITICAL. Returns a finding for each
+// problem with the counts, then one for each problem with the health, or none if there are no problems. They're kept
+// apart because an instance or target can take a while to pass its health checks after a deployment settles.
+//
+func checkLoadBalancers(clients *Clients, clusterName string, service *ecs.Service, tasks []TaskInfo,
+	taskRunning int) ([]CheckFinding, []CheckFinding, error) {
+	var findings, health []CheckFinding
+	var balancerNames = make([]*string, 0)
+	var targetGroupArns = make([]*string, 0)
+	for _, bals := range service.LoadBalancers {
+		if bals.TargetGroupArn != nil {
+			targetGroupArns = append(targetGroupArns, bals.TargetGroupArn)
+		} else if bals.LoadBalancerName != nil {
+			balancerNames = append(balancerNames, bals.LoadBalancerName)
+		}
+	}
+	if len(balancerNames) == 0 && len(targetGroupArns) == 0 {
+		return nil, nil, nil
+	}
+	var running []TaskInfo
+	for _, task := range tasks {
+		if task.LastStatus == "RUNNING" {
+			running = append(running, task)
+		}
+	}
+	// Classic ELBs and instance targets register the EC2 instances the tasks run on.
+	instanceIds, err := taskInstanceIds(clients, clusterName, running)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// A service without classic ELBs has no instance count to compare.
+	if len(balancerNames) > 0 {
+		var elbCount = 0
+		serviceElbs, err := GetElbData(clients, balancerNames)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, balancer := range serviceElbs.LoadBalancerDescriptions {
+			elbCount += len(balancer.Instances)
+		}
+		if elbCount == 0 && taskRunning > 0 {
+			findings = append(findings, CheckFinding{SeverityCritical, fmt.Sprintf("no instances registered with the ELB for %d running tasks", taskRunning)})
+		} else if elbCount != taskRunning {
+			findings = append(findings, CheckFinding{SeverityWarning, fmt.Sprintf("ELB instance count of %d is different from number of running tasks %d", elbCount, taskRunning)})
+		}
+	}
+	for _, name := range uniqueStrings(balancerNames) {
+		instances, err := getInstanceHealth(clients.ELB, *name)
+		if err != nil {
+			return nil, nil, err
+		}
+		var healthy int
+		var unhealthy []string
+		for _, instance := range instances {
+			taskIds := tasksOnInstance(running, instanceIds, instance.InstanceId, 0)
+			switch {
+			case len(taskIds) == 0: // Not one of the service's
+			case instance.State == elbInstanceInService:
+				healthy++
+			default:
+				unhealthy = append(unhealthy, fmt.Sprintf("instance %s of task %s is %s in ELB %s%s", instance.InstanceId,
+					str.Join(taskIds, ", "), instance.State, *name, healthReason(instance.Description)))
+			}
+		}
+		health = append(health, healthFindings("ELB "+*name, healthy, unhealthy)...)
+	}
+
+	for _, arn := range uniqueStrings(targetGroupArns) {
+		targets, err := getTargets(clients.ELBV2, *arn)
+		if err != nil {
+			return nil, nil, err
+		}
+		var name = targetGroupName(*arn)
+		var targetCount, healthy int
+		var unhealthy []string
+		for _, target := range targets {
+			if target.State != elbv2.TargetHealthStateEnumDraining {
+				targetCount++
+			}
+			var taskIds []string
+			if str.HasPrefix(target.Id, "i-") {
+				taskIds = tasksOnInstance(running, instanceIds, target.Id, target.Port)
+			} else {
+				taskIds = tasksWithIP(running, target.Id)
+			}
+			switch {
+			case len(taskIds) == 0: // Not one of the service's
+			case target.State == elbv2.TargetHealthStateEnumHealthy:
+				healthy++
+			case target.State == elbv2.TargetHealthStateEnumUnhealthy, target.State == elbv2.TargetHealthStateEnumUnavailable:
+				unhealthy = append(unhealthy, fmt.Sprintf("target %s:%d of task %s is %s in target group %s%s", target.Id,
+					target.Port, str.Join(taskIds, ", "), target.State, name, healthReason(target.Description)))
+			}
+		}
+		if targetCount == 0 && taskRunning > 0 {
+			findings = append(findings, CheckFinding{SeverityCritical, fmt.Sprintf("no targets registered with target group %s for %d running tasks", name, taskRunning)})
+		} else if targetCount != taskRunning {
+			findings = append(findings, CheckFinding{SeverityWarning, fmt.Sprintf("target group %s has %d targets registered but %d tasks running", name, targetCount, taskRunning)})
+		}
+		health = append(health, healthFindings("target group "+name, healthy, unhealthy)...)
+	}
+	return findings, health, nil
+}
+
+//
+// Turn the unhealthy registrations of the service's tasks in one load balancer into findings: a WARNING for each, and a
+// CRITICAL if none of the service's registrations there are healthy.
+//
+func healthFindings(balancer string, healthy int, unhealthy []string) []CheckFinding {
+	var findings []CheckFinding
+	if len(unhealthy) > 0 && healthy == 0 {
+		findings = append(findings, CheckFinding{SeverityCritical,
+			fmt.Sprintf("none of the service's tasks are healthy in %s, %d unhealthy", balancer, len(unhealthy))})
+	}
+	for _, message := range unhealthy {
+		findings = append(findings, CheckFinding{SeverityWarning, message})
+	}
+	return findings
+}
+
+// Add the description of why an instance or target is unhealthy to a message, if there is one.
+func healthReason(description string) string {
+	if description == "" {
+		return ""
+	}
+	return ": " + description
+}
+
+//
+// Find the EC2 instances the tasks run on, as a map from container instance ARN to instance ID. Tasks on Fargate have
+// no container instance, so if none of the tasks do, nothing is looked up.
+//
+func taskInstanceIds(clients *Clients, clusterName string, tasks []TaskInfo) (map[string]string, error) {
+	var instanceIds = map[string]string{}
+	var containerInstanceArns []*string
+	for index := range tasks {
+		if tasks[index].ContainerInstanceArn != "" {
+			containerInstanceArns = append(containerInstanceArns, &tasks[index].ContainerInstanceArn)
+		}
+	}
+	if len(containerInstanceArns) == 0 {
+		return instanceIds, nil
+	}
+	instances, err := describeContainerInstances(clients.ECS, clusterName, uniqueStrings(containerInstanceArns))
+	if err != nil {
+		return nil, err
+	}
+	for _, instance := range instances {
+		if instance.Ec2InstanceId != nil {
+			instanceIds[*instance.ContainerInstanceArn] = *instance.Ec2InstanceId
+		}
+	}
+	return instanceIds, nil
+}
+
+//
+// The IDs of the tasks running on an EC2 instance. If port isn't 0, only tasks with a container bound to that host port
+// count, since tasks sharing an instance with dynamic ports are told apart by port.
+//
+func tasksOnInstance(tasks []TaskInfo, instanceIds map[string]string, instanceId string, port int64) []string {
+	var taskIds []string
+	for _, task := range tasks {
+		if instanceIds[task.ContainerInstanceArn] != instanceId {
+			continue
+		}
+		var bound = port == 0
+		for _, binding := range task.NetworkBindings {
+			bound = bound || binding.HostPort == port
+		}
+		if bound {
+			taskIds = append(taskIds, getRevisionFromTaskDefinition(task.Arn))
+		}
+	}
+	return taskIds
+}
+
+// The IDs of the awsvpc tasks with the given private IP address.
+func tasksWithIP(tasks []TaskInfo, ip string) []string {
+	var taskIds []string
+	for _, task := range tasks {
+		if task.PrivateIP == ip {
+			taskIds = append(taskIds, getRevisionFromTaskDefinition(task.Arn))
+		}
+	}
+	return taskIds
+}
@@ -0,0 +1,136 @@
+package components
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+)
+
+func TestCheckServiceTargetHealth(t *testing.T) {
+	fake := newFakeECS()
+	current := fake.addTaskDefinition("api", fakeContainer("api", "acme/api:v2"))
+	addBalancedService := func(name string, targetGroupArn string) {
+		fake.addService(name, current, 2)
+		fake.services[name].LoadBalancers = []*ecs.LoadBalancer{{
+			TargetGroupArn: aws.String(targetGroupArn),
+			ContainerName:  aws.String("api"),
+			ContainerPort:  aws.Int64(8080),
+		}}
+	}
+
+	// awsvpc tasks, registered by IP address.
+	addBalancedService("api", fake.elbv2.addTargetGroup("api", "healthy", "unhealthy"))
+	fake.addTaskWithIP("api", current, "10.0.1.1")
+	fake.addTaskWithIP("api", current, "10.0.1.2")
+	addBalancedService("down", fake.elbv2.addTargetGroup("down", "unhealthy", "unavailable"))
+	fake.addTaskWithIP("down", current, "10.0.1.1")
+	fake.addTaskWithIP("down", current, "10.0.1.2")
+
+	// Tasks sharing an instance with dynamic host ports, registered by instance and port.
+	bridgeArn := fake.elbv2.addTargetGroup("bridge")
+	fake.elbv2.targets[bridgeArn] = []*elbv2.TargetHealthDescription{
+		{Target: &elbv2.TargetDescription{Id: aws.String("i-0a1b2c3d"), Port: aws.Int64(32768)},
+			TargetHealth: &elbv2.TargetHealth{State: aws.String("healthy")}},
+		{Target: &elbv2.TargetDescription{Id: aws.String("i-0a1b2c3d"), Port: aws.Int64(32769)},
+			TargetHealth: &elbv2.TargetHealth{State: aws.String("unhealthy"), Reason: aws.String("Target.Timeout"),
+				Description: aws.String("Request timed out")}},
+	}
+	addBalancedService("bridge", bridgeArn)
+	fake.addTaskOnInstance("bridge", current, "i-0a1b2c3d", 32768)
+	fake.addTaskOnInstance("bridge", current, "i-0a1b2c3d", 32769)
+
+	tests := []struct {
+		service  string
+		status   Severity
+		findings []CheckFinding
+	}{
+		{"api", SeverityWarning, []CheckFinding{{SeverityWarning,
+			"target 10.0.1.2:8080 of task 2 is unhealthy in target group api: Health checks failed with these codes: [502]"}}},
+		{"down", SeverityCritical, []CheckFinding{
+			{SeverityCritical, "none of the service's tasks are healthy in target group down, 2 unhealthy"},
+			{SeverityWarning, "target 10.0.1.1:8080 of task 3 is unhealthy in target group down: Health checks failed with these codes: [502]"},
+			{SeverityWarning, "target 10.0.1.2:8080 of task 4 is unavailable in target group down"}}},
+		{"bridge", SeverityWarning, []CheckFinding{{SeverityWarning,
+			"target i-0a1b2c3d:32769 of task 6 is unhealthy in target group bridge: Request timed out"}}},
+	}
+	for _, test := range tests {
+		check, err := CheckService(fake.clients(), "prod", test.service)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if check.Status != test.status || !reflect.DeepEqual(check.Findings, test.findings) {
+			t.Errorf("%s: got %s with %v, want %s with %v", test.service, check.Status, check.Findings, test.status, test.findings)
+		}
+	}
+}
+
+func TestCheckServiceInstanceHealth(t *testing.T) {
+	fake := newFakeECS()
+	current := fake.addTaskDefinition("web", fakeContainer("web", "acme/web:v2"))
+	fake.addService("web", current, 2)
+	fake.services["web"].LoadBalancers = []*ecs.LoadBalancer{{
+		LoadBalancerName: aws.String("web"),
+		ContainerName:    aws.String("web"),
+		ContainerPort:    aws.Int64(8080),
+	}}
+	fake.elb.addLoadBalancer("web", "i-0a1b2c3d=InService", "i-0e1f2a3b=OutOfService")
+	fake.addTaskOnInstance("web", current, "i-0a1b2c3d", 8080)
+	fake.addTaskOnInstance("web", current, "i-0e1f2a3b", 8080)
+
+	check, err := CheckService(fake.clients(), "prod", "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []CheckFinding{{SeverityWarning, "instance i-0e1f2a3b of task 2 is OutOfService in ELB web: " +
+		"Instance has failed at least the UnhealthyThreshold number of health checks consecutively."}}
+	if check.Status != SeverityWarning || !reflect.DeepEqual(check.Findings, want) {
+		t.Errorf("got %s with %v, want WARNING with %v", check.Status, check.Findings, want)
+	}
+
+	balancers, err := GetLoadBalancers(fake.clients(), []*string{aws.String("web")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if health := balancers[0].InstanceHealth; len(health) != 2 || health[0].State != "InService" || health[1].ReasonCode != "Instance" {
+		t.Errorf("got instance health %+v", health)
+	}
+}
+
+func TestParseCheckArguments(t *testing.T) {
+	tests := []struct {
+		args     []string
+		all      bool
+		clusters []string
+		service  string
+		invalid  bool
+	}{
+		{[]string{"prod", "api"}, false, []string{"prod"}, "api", false},
+		{[]string{"prod"}, false, []string{"prod"}, "", false},
+		{nil, true, nil, "", false},
+		{[]string{"--all"}, false, nil, "", false},
+		{[]string{"-all"}, false, nil, "", false},
+		{nil, false, nil, "", true},
+		{[]string{"prod"}, true, nil, "", true},
+		{[]string{"--all", "prod"}, false, nil, "", true},
+		{[]string{"prod", "-v"}, false, nil, "", true},
+		{[]string{"prod", "api", "extra"}, false, nil, "", true},
+	}
+	var validation *ValidationError
+	for _, test := range tests {
+		clusters, service, err := ParseCheckArguments(test.args, test.all)
+		if test.invalid {
+			if !errors.As(err, &validation) {
+				t.Errorf("%v with all %v returned %v, want a ValidationError", test.args, test.all, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(clusters, test.clusters) || service != test.service {
+			t.Errorf("%v with all %v returned %v, %q, %v, want %v, %q", test.args, test.all, clusters, service, err,
+				test.clusters, test.service)
+		}
+	}
+}
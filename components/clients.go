@@ -0,0 +1,63 @@
+/*
+The AWS session and service clients shared by all the operations.
+
+Womply, www.womply.com
+*/
+package components
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+	"github.com/aws/aws-sdk-go/service/elb"
+	"github.com/aws/aws-sdk-go/service/elb/elbiface"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+)
+
+// How many times a failed API call is retried unless the caller says otherwise.
+const DefaultMaxRetries = 8
+
+//
+// Clients holds the service clients, all made from one session so the configuration is only read once.
+//
+type Clients struct {
+	ECS   ecsiface.ECSAPI
+	ELB   elbiface.ELBAPI     // Classic load balancers
+	ELBV2 elbv2iface.ELBV2API // Application and network load balancers, and their target groups
+}
+
+//
+// Create the session and service clients for a region. Throttling errors and transient ones such as timeouts and 5xx
+// responses are retried up to maxRetries times, waiting longer each time with some random jitter, before they're
+// reported. Every request carries a user agent of ecsman and its version.
+//
+func NewClients(creds *credentials.Credentials, region string, maxRetries int, version string) (*Clients, error) {
+	awsSession, err := session.NewSession(&aws.Config{
+		Region:      aws.String(region),
+		Credentials: creds,
+		Retryer: client.DefaultRetryer{
+			NumMaxRetries:    maxRetries,
+			MinRetryDelay:    100 * time.Millisecond,
+			MaxRetryDelay:    10 * time.Second,
+			MinThrottleDelay: 500 * time.Millisecond,
+			MaxThrottleDelay: 30 * time.Second,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("creating AWS session: %w", err)
+	}
+	awsSession.Handlers.Build.PushBack(request.MakeAddToUserAgentHandler("ecsman", version))
+	return &Clients{
+		ECS:   ecs.New(awsSession),
+		ELB:   elb.New(awsSession),
+		ELBV2: elbv2.New(awsSession),
+	}, nil
+}
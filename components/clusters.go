@@ -7,34 +7,91 @@ package components
 
 import (
 	"fmt"
-
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/service/ecs"
 )
 
 //
-// List the user-visible clusters and their service names.
+// ClusterInfo describes a cluster, its counts and the services in it.
+//
+type ClusterInfo struct {
+	Name               string           `json:"name"`
+	Arn                string           `json:"arn"`
+	Status             string           `json:"status"`
+	ActiveServices     int64            `json:"activeServicesCount"`
+	ContainerInstances int64            `json:"registeredContainerInstancesCount"`
+	RunningTasks       int64            `json:"runningTasksCount"`
+	PendingTasks       int64            `json:"pendingTasksCount"`
+	Services           []ServiceSummary `json:"services"`
+}
+
+// ServiceSummary is the short description of a service shown in a cluster listing.
+type ServiceSummary struct {
+	Name         string `json:"name"`
+	Status       string `json:"status"`
+	RunningCount int64  `json:"runningCount"`
+}
+
+//
+// List the user-visible clusters and their service names. The services of up to concurrency clusters are fetched at
+// the same time, and the clusters come back in the order ECS lists them.
+//
+func ListClusters(clients *Clients, concurrency int) ([]ClusterInfo, error) {
+	awsConn := clients.ECS
+	clusterArns, err := listClusterArns(awsConn)
+	if err != nil {
+		return nil, err
+	}
+	clusters, err := describeClusters(awsConn, clusterArns)
+	if err != nil {
+		return nil, err
+	}
+	var clusterInfos = make([]ClusterInfo, len(clusters))
+	err = forEachConcurrently(len(clusters), concurrency, func(index int) error {
+		cluster := clusters[index]
+		info := ClusterInfo{
+			Name:               *cluster.ClusterName,
+			Arn:                *cluster.ClusterArn,
+			Status:             *cluster.Status,
+			ActiveServices:     *cluster.ActiveServicesCount,
+			ContainerInstances: *cluster.RegisteredContainerInstancesCount,
+			RunningTasks:       *cluster.RunningTasksCount,
+			PendingTasks:       *cluster.PendingTasksCount,
+			Services:           []ServiceSummary{},
+		}
+		serviceArns, err := listServiceArns(awsConn, *cluster.ClusterArn)
+		if err != nil {
+			return err
+		}
+		services, err := describeServices(awsConn, *cluster.ClusterArn, serviceArns)
+		if err != nil {
+			return err
+		}
+		for _, service := range services {
+			info.Services = append(info.Services, ServiceSummary{
+				Name:         *service.ServiceName,
+				Status:       *service.Status,
+				RunningCount: *service.RunningCount,
+			})
+		}
+		clusterInfos[index] = info
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return clusterInfos, nil
+}
+
+//
+// Print the clusters fetched by ListClusters.
 //
-func ListClusters(creds *credentials.Credentials, region string) {
-	awsConn := GetEcsConnection(creds, region)
-	clusterList, err := awsConn.ListClusters(&ecs.ListClustersInput{})
-	CheckError("fetching clusters list", err)
-	clusters, err := awsConn.DescribeClusters(&ecs.DescribeClustersInput{Clusters: clusterList.ClusterArns})
-	CheckError("fetching cluster data", err)
-	for _, cluster := range clusters.Clusters {
+func PrintClusters(clusters []ClusterInfo) {
+	for _, cluster := range clusters {
 		PrintSeparator()
-		fmt.Printf("Cluster: %s (%s)\n", *cluster.ClusterName, *cluster.Status)
-		fmt.Println(" ", *cluster.ActiveServicesCount, "services active,", *cluster.RegisteredContainerInstancesCount, "containers")
-		fmt.Println("  Tasks:", *cluster.RunningTasksCount, "running,", *cluster.PendingTasksCount, "pending")
-		serviceList, err := awsConn.ListServices(&ecs.ListServicesInput{Cluster: cluster.ClusterArn})
-		CheckError(fmt.Sprintf("finding services for cluster %s", *cluster.ClusterName), err)
-		serviceInfo, err := awsConn.DescribeServices(&ecs.DescribeServicesInput{
-			Cluster:  cluster.ClusterArn,
-			Services: serviceList.ServiceArns,
-		})
-		CheckError(fmt.Sprintf("fetching service data for cluster %s", *cluster.ClusterName), err)
-		for _, service := range serviceInfo.Services {
-			fmt.Printf("  - Service: %s (%s), running count: %d\n", *service.ServiceName, *service.Status, *service.RunningCount)
+		fmt.Printf("Cluster: %s (%s)\n", cluster.Name, cluster.Status)
+		fmt.Println(" ", cluster.ActiveServices, "services active,", cluster.ContainerInstances, "containers")
+		fmt.Println("  Tasks:", cluster.RunningTasks, "running,", cluster.PendingTasks, "pending")
+		for _, service := range cluster.Services {
+			fmt.Printf("  - Service: %s (%s), running count: %d\n", service.Name, service.Status, service.RunningCount)
 		}
 	}
 }
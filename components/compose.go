@@ -0,0 +1,507 @@
+/*
+Functions that turn docker-compose files into ECS task definitions.
+
+Womply, www.womply.com
+*/
+package components
+
+import str "strings"
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"gopkg.in/yaml.v3"
+)
+
+// The compose depends_on conditions, mapped to the ECS dependsOn conditions that mean the same thing.
+var composeConditions = map[string]string{
+	"service_started":                ecs.ContainerConditionStart,
+	"service_healthy":                ecs.ContainerConditionHealthy,
+	"service_completed_successfully": ecs.ContainerConditionSuccess,
+}
+
+//
+// Convert the services in a docker-compose file into a task definition for the given family, with one container per
+// service. Images, commands, entrypoints, environment, ports, ulimits, depends_on, resource limits, health checks and a
+// few other settings are carried over. Compose features that ECS has no equivalent for, such as build contexts and
+// volumes, are reported as warnings on stderr. The task definition is printed as JSON that register accepts, or, if
+// register is set, checked and registered straight away.
+//
+func ImportCompose(clients *Clients, composeFile string, family string, register bool) error {
+	fileBytes, err := ioutil.ReadFile(composeFile)
+	if err != nil {
+		return fmt.Errorf("reading compose file %s: %w", composeFile, err)
+	}
+	var compose map[string]interface{}
+	if err = yaml.Unmarshal(fileBytes, &compose); err != nil {
+		return &ValidationError{Message: fmt.Sprintf("parsing compose file %s: %v", composeFile, err)}
+	}
+
+	services, ok := compose["services"].(map[string]interface{})
+	if !ok || len(services) == 0 {
+		return &ValidationError{Message: fmt.Sprintf("compose file %s has no services", composeFile)}
+	}
+	for key := range compose {
+		switch key {
+		case "services", "version", "name":
+		default:
+			composeWarning("top-level %s are not imported", key)
+		}
+	}
+
+	// Go through the services in name order, so the same file always gives the same task definition.
+	names := make([]string, 0, len(services))
+	for name := range services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	taskDefinition := &ecs.RegisterTaskDefinitionInput{Family: &family}
+	for _, name := range names {
+		settings, ok := services[name].(map[string]interface{})
+		if !ok {
+			settings = map[string]interface{}{}
+		}
+		taskDefinition.ContainerDefinitions = append(taskDefinition.ContainerDefinitions, composeContainer(name, settings))
+	}
+	// A container that others wait on to finish can't be essential, or the task would stop when it does.
+	for _, container := range taskDefinition.ContainerDefinitions {
+		for _, dependency := range container.DependsOn {
+			if *dependency.Condition == ecs.ContainerConditionSuccess || *dependency.Condition == ecs.ContainerConditionComplete {
+				if target := findContainerDefinition(taskDefinition.ContainerDefinitions, *dependency.ContainerName); target != nil {
+					target.Essential = aws.Bool(false)
+				}
+			}
+		}
+	}
+
+	if !register {
+		taskDefinitionText, err := taskDefinitionJSON(taskDefinition)
+		if err != nil {
+			return err
+		}
+		fmt.Println(escapeTemplate(taskDefinitionText)) // So that register leaves any ${NAME} as it is
+		return nil
+	}
+	if problems := checkTaskDefinition(taskDefinition); len(problems) > 0 {
+		validationErr := &ValidationError{Message: "the imported task definition has problems, nothing was registered"}
+		for _, problem := range problems {
+			validationErr.Problems = append(validationErr.Problems, fmt.Sprintf("%s: %s", problem.path, problem.message))
+		}
+		return validationErr
+	}
+	fmt.Printf("Registering Task Definition...\n\n")
+	_, err = registerTaskDefinition(clients.ECS, taskDefinition)
+	return err
+}
+
+/////////////// Private functions
+
+//
+// Build the container definition for one compose service.
+//
+func composeContainer(name string, settings map[string]interface{}) *ecs.ContainerDefinition {
+	container := &ecs.ContainerDefinition{
+		Name:      aws.String(name),
+		Essential: aws.Bool(true),
+	}
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := settings[key]
+		switch key {
+		case "image":
+			container.Image = aws.String(composeString(value))
+		case "build":
+			if _, hasImage := settings["image"]; !hasImage {
+				composeWarning("service %s uses a build context, which ECS can't build; set an image for it", name)
+			}
+		case "command":
+			container.Command = aws.StringSlice(composeCommand(value))
+		case "entrypoint":
+			container.EntryPoint = aws.StringSlice(composeCommand(value))
+		case "environment":
+			container.Environment = composeEnvironment(name, value)
+		case "ports":
+			for _, port := range composeList(value) {
+				if mapping := composePortMapping(name, port); mapping != nil {
+					container.PortMappings = append(container.PortMappings, mapping)
+				}
+			}
+		case "ulimits":
+			container.Ulimits = composeUlimits(value)
+		case "depends_on":
+			container.DependsOn = composeDependsOn(name, value)
+		case "deploy":
+			composeDeploy(name, container, value)
+		case "mem_limit":
+			container.Memory = composeMemory(name, value)
+		case "mem_reservation":
+			container.MemoryReservation = composeMemory(name, value)
+		case "cpus":
+			container.Cpu = composeCpus(name, value)
+		case "cpu_shares":
+			container.Cpu = aws.Int64(composeInt(value))
+		case "healthcheck":
+			container.HealthCheck = composeHealthCheck(name, value)
+		case "working_dir":
+			container.WorkingDirectory = aws.String(composeString(value))
+		case "user":
+			container.User = aws.String(composeString(value))
+		case "hostname":
+			container.Hostname = aws.String(composeString(value))
+		case "labels":
+			container.DockerLabels = aws.StringMap(composeStringMap(value))
+		case "links":
+			container.Links = aws.StringSlice(composeStrings(composeList(value)))
+		case "privileged":
+			container.Privileged = aws.Bool(value == true)
+		case "read_only":
+			container.ReadonlyRootFilesystem = aws.Bool(value == true)
+		case "stop_grace_period":
+			if duration, err := time.ParseDuration(composeString(value)); err == nil {
+				container.StopTimeout = aws.Int64(int64(duration.Seconds()))
+			} else {
+				composeWarning("service %s has a stop_grace_period that can't be read: %v", name, value)
+			}
+		case "container_name":
+			composeWarning("service %s: container_name is ignored, the container is named %s", name, name)
+		default:
+			composeWarning("service %s: %s has no ECS equivalent and is not imported", name, key)
+		}
+	}
+	return container
+}
+
+//
+// Compose environments are either a map of names to values, or a list of NAME=value strings. A name with no value at
+// all, a bare NAME in the list or a NAME: with nothing after it, is taken from the environment ecsman runs in, as
+// compose does. An explicit empty value, NAME= or NAME: "", stays empty.
+//
+func composeEnvironment(service string, value interface{}) []*ecs.KeyValuePair {
+	environment := map[string]*string{}
+	if mapping, ok := value.(map[string]interface{}); ok {
+		for name, item := range mapping {
+			if item != nil {
+				environment[name] = aws.String(composeString(item))
+			} else {
+				environment[name] = nil
+			}
+		}
+	} else {
+		for _, item := range composeStrings(composeList(value)) {
+			if pos := str.Index(item, "="); pos != -1 {
+				environment[item[:pos]] = aws.String(item[pos+1:])
+			} else {
+				environment[item] = nil
+			}
+		}
+	}
+	names := make([]string, 0, len(environment))
+	for name := range environment {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var pairs []*ecs.KeyValuePair
+	for _, name := range names {
+		envValue := environment[name]
+		if envValue == nil {
+			hostValue, found := os.LookupEnv(name)
+			if !found {
+				composeWarning("service %s: environment variable %s has no value", service, name)
+			}
+			envValue = aws.String(hostValue)
+		}
+		pairs = append(pairs, &ecs.KeyValuePair{Name: aws.String(name), Value: envValue})
+	}
+	return pairs
+}
+
+//
+// Compose ports are either "[ip:][hostPort:]containerPort[/protocol]" strings, bare numbers, or maps with target,
+// published and protocol. Port ranges have no ECS equivalent, so they're skipped with a warning.
+//
+func composePortMapping(service string, port interface{}) *ecs.PortMapping {
+	mapping := &ecs.PortMapping{}
+	if long, ok := port.(map[string]interface{}); ok {
+		mapping.ContainerPort = aws.Int64(composeInt(long["target"]))
+		if published, found := long["published"]; found {
+			mapping.HostPort = aws.Int64(composeInt(published))
+		}
+		if protocol, found := long["protocol"]; found {
+			mapping.Protocol = aws.String(composeString(protocol))
+		}
+		return mapping
+	}
+
+	var spec = composeString(port)
+	if pos := str.Index(spec, "/"); pos != -1 {
+		mapping.Protocol = aws.String(spec[pos+1:])
+		spec = spec[:pos]
+	}
+	parts := str.Split(spec, ":")
+	if str.Contains(spec, "-") {
+		composeWarning("service %s: port range %s can't be mapped, skipped", service, composeString(port))
+		return nil
+	}
+	containerPort, err := strconv.ParseInt(parts[len(parts)-1], 10, 64)
+	if err != nil {
+		composeWarning("service %s: port %s can't be read, skipped", service, composeString(port))
+		return nil
+	}
+	mapping.ContainerPort = aws.Int64(containerPort)
+	if len(parts) > 1 && parts[len(parts)-2] != "" {
+		hostPort, err := strconv.ParseInt(parts[len(parts)-2], 10, 64)
+		if err != nil {
+			composeWarning("service %s: host port in %s can't be read, skipped", service, composeString(port))
+			return nil
+		}
+		mapping.HostPort = aws.Int64(hostPort)
+	}
+	if len(parts) > 2 {
+		composeWarning("service %s: host IP in port %s is ignored", service, composeString(port))
+	}
+	return mapping
+}
+
+// Compose ulimits map a name to either a single limit or to soft and hard limits.
+func composeUlimits(value interface{}) []*ecs.Ulimit {
+	limits, _ := value.(map[string]interface{})
+	names := make([]string, 0, len(limits))
+	for name := range limits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var ulimits []*ecs.Ulimit
+	for _, name := range names {
+		ulimit := &ecs.Ulimit{Name: aws.String(name)}
+		if pair, ok := limits[name].(map[string]interface{}); ok {
+			ulimit.SoftLimit = aws.Int64(composeInt(pair["soft"]))
+			ulimit.HardLimit = aws.Int64(composeInt(pair["hard"]))
+		} else {
+			ulimit.SoftLimit = aws.Int64(composeInt(limits[name]))
+			ulimit.HardLimit = ulimit.SoftLimit
+		}
+		ulimits = append(ulimits, ulimit)
+	}
+	return ulimits
+}
+
+// Compose depends_on is either a list of service names, meaning they have started, or a map to their conditions.
+func composeDependsOn(service string, value interface{}) []*ecs.ContainerDependency {
+	conditions := map[string]string{}
+	if long, ok := value.(map[string]interface{}); ok {
+		for name, settings := range long {
+			conditions[name] = "service_started"
+			if settingsMap, ok := settings.(map[string]interface{}); ok && settingsMap["condition"] != nil {
+				conditions[name] = composeString(settingsMap["condition"])
+			}
+		}
+	} else {
+		for _, name := range composeStrings(composeList(value)) {
+			conditions[name] = "service_started"
+		}
+	}
+	names := make([]string, 0, len(conditions))
+	for name := range conditions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var dependencies []*ecs.ContainerDependency
+	for _, name := range names {
+		condition, known := composeConditions[conditions[name]]
+		if !known {
+			composeWarning("service %s: depends_on condition %s for %s has no ECS equivalent, using START", service, conditions[name], name)
+			condition = ecs.ContainerConditionStart
+		}
+		dependencies = append(dependencies, &ecs.ContainerDependency{ContainerName: aws.String(name), Condition: aws.String(condition)})
+	}
+	return dependencies
+}
+
+// Take the CPU and memory limits and reservations from a compose deploy section. The rest of it is about swarm.
+func composeDeploy(service string, container *ecs.ContainerDefinition, value interface{}) {
+	deploy, _ := value.(map[string]interface{})
+	for key, setting := range deploy {
+		if key != "resources" {
+			composeWarning("service %s: deploy.%s has no ECS equivalent and is not imported", service, key)
+			continue
+		}
+		resources, _ := setting.(map[string]interface{})
+		if limits, ok := resources["limits"].(map[string]interface{}); ok {
+			if cpus, found := limits["cpus"]; found {
+				container.Cpu = composeCpus(service, cpus)
+			}
+			if memory, found := limits["memory"]; found {
+				container.Memory = composeMemory(service, memory)
+			}
+		}
+		if reservations, ok := resources["reservations"].(map[string]interface{}); ok {
+			if memory, found := reservations["memory"]; found {
+				container.MemoryReservation = composeMemory(service, memory)
+			}
+		}
+	}
+}
+
+// Compose health checks use durations like "30s" where ECS wants whole seconds.
+func composeHealthCheck(service string, value interface{}) *ecs.HealthCheck {
+	settings, _ := value.(map[string]interface{})
+	if settings["disable"] == true {
+		return nil
+	}
+	var test []string
+	if list, ok := settings["test"].([]interface{}); ok {
+		test = composeStrings(list)
+	} else if settings["test"] != nil {
+		test = []string{"CMD-SHELL", composeString(settings["test"])}
+	}
+	if len(test) == 0 || test[0] == "NONE" {
+		return nil
+	}
+	healthCheck := &ecs.HealthCheck{Command: aws.StringSlice(test)}
+	seconds := func(key string) *int64 {
+		if settings[key] == nil {
+			return nil
+		}
+		duration, err := time.ParseDuration(composeString(settings[key]))
+		if err != nil {
+			composeWarning("service %s: healthcheck %s can't be read: %v", service, key, settings[key])
+			return nil
+		}
+		return aws.Int64(int64(duration.Seconds()))
+	}
+	healthCheck.Interval = seconds("interval")
+	healthCheck.Timeout = seconds("timeout")
+	healthCheck.StartPeriod = seconds("start_period")
+	if settings["retries"] != nil {
+		healthCheck.Retries = aws.Int64(composeInt(settings["retries"]))
+	}
+	return healthCheck
+}
+
+// Compose counts CPUs, such as "0.5", where ECS counts CPU units, 1024 to a CPU.
+func composeCpus(service string, value interface{}) *int64 {
+	cpus, err := strconv.ParseFloat(composeString(value), 64)
+	if err != nil {
+		composeWarning("service %s: cpus %v can't be read", service, value)
+		return nil
+	}
+	return aws.Int64(int64(cpus * 1024))
+}
+
+// Compose memory sizes are bytes, optionally with a b, k, m or g suffix. ECS wants MiB.
+func composeMemory(service string, value interface{}) *int64 {
+	var size = str.TrimSuffix(str.ToLower(str.TrimSpace(composeString(value))), "b")
+	var perMiB = float64(1024 * 1024) // Plain bytes
+	if size != "" {
+		switch size[len(size)-1] {
+		case 'k':
+			perMiB, size = 1024, size[:len(size)-1]
+		case 'm':
+			perMiB, size = 1, size[:len(size)-1]
+		case 'g':
+			perMiB, size = 1.0/1024, size[:len(size)-1]
+		}
+	}
+	number, err := strconv.ParseFloat(size, 64)
+	if err != nil {
+		composeWarning("service %s: memory size %v can't be read", service, value)
+		return nil
+	}
+	return aws.Int64(int64(number / perMiB))
+}
+
+//
+// A compose command is either a list, or a string that's split into words the way a shell would, honouring quotes.
+//
+func composeCommand(value interface{}) []string {
+	if list, ok := value.([]interface{}); ok {
+		return composeStrings(list)
+	}
+	var words []string
+	var word str.Builder
+	var inWord = false
+	var quote rune
+	for _, char := range composeString(value) {
+		switch {
+		case quote != 0 && char == quote:
+			quote = 0
+		case quote != 0:
+			word.WriteRune(char)
+		case char == '"' || char == '\'':
+			quote, inWord = char, true
+		case char == ' ' || char == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(char)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words
+}
+
+// Compose uses both maps and lists of name=value strings for things like environment and labels.
+func composeStringMap(value interface{}) map[string]string {
+	result := map[string]string{}
+	if mapping, ok := value.(map[string]interface{}); ok {
+		for key, item := range mapping {
+			result[key] = composeString(item)
+		}
+		return result
+	}
+	for _, item := range composeStrings(composeList(value)) {
+		if pos := str.Index(item, "="); pos != -1 {
+			result[item[:pos]] = item[pos+1:]
+		} else {
+			result[item] = ""
+		}
+	}
+	return result
+}
+
+func composeList(value interface{}) []interface{} {
+	list, _ := value.([]interface{})
+	return list
+}
+
+func composeStrings(list []interface{}) []string {
+	var strs []string
+	for _, item := range list {
+		strs = append(strs, composeString(item))
+	}
+	return strs
+}
+
+// YAML turns unquoted values into numbers and booleans, but compose means most of them as strings.
+func composeString(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	return fmt.Sprint(value)
+}
+
+func composeInt(value interface{}) int64 {
+	number, _ := strconv.ParseInt(composeString(value), 10, 64)
+	return number
+}
+
+// Warnings go to stderr, so that the printed task definition can be redirected into a file on its own.
+func composeWarning(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "WARNING: "+format+"\n", args...)
+}
@@ -0,0 +1,113 @@
+package components
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"gopkg.in/yaml.v3"
+)
+
+func TestComposeContainer(t *testing.T) {
+	os.Setenv("ECSMAN_TEST_HOSTED", "from-host")
+	defer os.Unsetenv("ECSMAN_TEST_HOSTED")
+	os.Setenv("ECSMAN_TEST_EMPTY", "from-host") // Set, but an explicit empty value wins
+	defer os.Unsetenv("ECSMAN_TEST_EMPTY")
+	os.Unsetenv("ECSMAN_TEST_UNSET")
+
+	tests := []struct {
+		name     string
+		settings string // The compose service, as YAML
+		want     ecs.ContainerDefinition
+	}{
+		{"ports", `
+ports:
+  - 8080
+  - "80:8080"
+  - "127.0.0.1:443:8443/tcp"
+  - "9000-9001:9000-9001"
+  - "http"
+  - {target: 53, published: 5353, protocol: udp}`,
+			ecs.ContainerDefinition{PortMappings: []*ecs.PortMapping{
+				{ContainerPort: aws.Int64(8080)},
+				{ContainerPort: aws.Int64(8080), HostPort: aws.Int64(80)},
+				{ContainerPort: aws.Int64(8443), HostPort: aws.Int64(443), Protocol: aws.String("tcp")},
+				{ContainerPort: aws.Int64(53), HostPort: aws.Int64(5353), Protocol: aws.String("udp")},
+			}}},
+		{"resources", `
+mem_limit: 512m
+mem_reservation: 1g
+cpus: 0.5`,
+			ecs.ContainerDefinition{Memory: aws.Int64(512), MemoryReservation: aws.Int64(1024), Cpu: aws.Int64(512)}},
+		{"deploy resources", `
+deploy:
+  replicas: 2
+  resources:
+    limits: {cpus: "0.25", memory: 268435456}
+    reservations: {memory: 65536k}`,
+			ecs.ContainerDefinition{Memory: aws.Int64(256), MemoryReservation: aws.Int64(64), Cpu: aws.Int64(256)}},
+		{"unreadable resources", `
+mem_limit: lots
+cpus: many`,
+			ecs.ContainerDefinition{}},
+		{"depends_on list", `
+depends_on: [proxy, db]`,
+			ecs.ContainerDefinition{DependsOn: []*ecs.ContainerDependency{
+				{ContainerName: aws.String("db"), Condition: aws.String("START")},
+				{ContainerName: aws.String("proxy"), Condition: aws.String("START")},
+			}}},
+		{"depends_on conditions", `
+depends_on:
+  db: {condition: service_healthy}
+  migrate: {condition: service_completed_successfully}
+  proxy: {condition: service_started}
+  cache: {condition: service_ready}
+  queue: {}`,
+			ecs.ContainerDefinition{DependsOn: []*ecs.ContainerDependency{
+				{ContainerName: aws.String("cache"), Condition: aws.String("START")},
+				{ContainerName: aws.String("db"), Condition: aws.String("HEALTHY")},
+				{ContainerName: aws.String("migrate"), Condition: aws.String("SUCCESS")},
+				{ContainerName: aws.String("proxy"), Condition: aws.String("START")},
+				{ContainerName: aws.String("queue"), Condition: aws.String("START")},
+			}}},
+		{"environment map", `
+environment:
+  PORT: 8080
+  DEBUG: true
+  ECSMAN_TEST_EMPTY: ""
+  ECSMAN_TEST_HOSTED:
+  ECSMAN_TEST_UNSET:`,
+			ecs.ContainerDefinition{Environment: []*ecs.KeyValuePair{
+				{Name: aws.String("DEBUG"), Value: aws.String("true")},
+				{Name: aws.String("ECSMAN_TEST_EMPTY"), Value: aws.String("")},
+				{Name: aws.String("ECSMAN_TEST_HOSTED"), Value: aws.String("from-host")},
+				{Name: aws.String("ECSMAN_TEST_UNSET"), Value: aws.String("")},
+				{Name: aws.String("PORT"), Value: aws.String("8080")},
+			}}},
+		{"environment list", `
+environment:
+  - PORT=8080
+  - ECSMAN_TEST_EMPTY=
+  - ECSMAN_TEST_HOSTED
+  - URL=http://host/?a=b`,
+			ecs.ContainerDefinition{Environment: []*ecs.KeyValuePair{
+				{Name: aws.String("ECSMAN_TEST_EMPTY"), Value: aws.String("")},
+				{Name: aws.String("ECSMAN_TEST_HOSTED"), Value: aws.String("from-host")},
+				{Name: aws.String("PORT"), Value: aws.String("8080")},
+				{Name: aws.String("URL"), Value: aws.String("http://host/?a=b")},
+			}}},
+	}
+	for _, test := range tests {
+		var settings map[string]interface{}
+		if err := yaml.Unmarshal([]byte(test.settings), &settings); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		want := test.want
+		want.Name, want.Essential = aws.String("api"), aws.Bool(true)
+		if got := composeContainer("api", settings); !reflect.DeepEqual(*got, want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, want)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+/*
+Functions that follow an ECS service deployment until it settles.
+
+Womply, www.womply.com
+*/
+package components
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+)
+
+// How often to poll the service while waiting for a deployment to settle.
+const deploymentPollInterval = 10 * time.Second
+
+//
+// Poll the service until its PRIMARY deployment, which should be the one with the given ID that updating the service
+// started, has as many running tasks as it wants and the older deployments have drained. Prints a progress line
+// whenever the counts change. Returns nil once the service is stable, a DeploymentError with the reason if the
+// deployment failed or timed out, or the error from AWS if the service couldn't be fetched. The timeout runs from
+// started, when the service was updated.
+//
+func waitForDeployment(awsConn ecsiface.ECSAPI, clusterName string, serviceName string, deploymentId string,
+	started time.Time, timeout time.Duration) error {
+
+	fmt.Println("  -> Waiting up to", timeout, "for the deployment to reach a steady state")
+	var deadline = started.Add(timeout)
+	var lastProgress = ""
+	for {
+		serviceInfo, err := awsConn.DescribeServices(&ecs.DescribeServicesInput{
+			Cluster:  &clusterName,
+			Services: []*string{&serviceName},
+		})
+		if err != nil {
+			return apiError(fmt.Sprintf("fetching service data for service %s", serviceName), err)
+		}
+		if len(serviceInfo.Services) == 0 {
+			return &DeploymentError{Reason: fmt.Sprintf("service %s disappeared while waiting", serviceName)}
+		}
+
+		var primary *ecs.Deployment
+		var draining, drainingTasks int64
+		for _, depl := range serviceInfo.Services[0].Deployments {
+			if *depl.Status == "PRIMARY" {
+				primary = depl
+			} else {
+				draining++
+				drainingTasks += *depl.RunningCount
+			}
+		}
+		if primary == nil {
+			return &DeploymentError{Reason: "service has no PRIMARY deployment"}
+		}
+		if *primary.Id != deploymentId {
+			return &DeploymentError{Reason: fmt.Sprintf("deployment was superseded by %s", getRevisionFromTaskDefinition(*primary.TaskDefinition))}
+		}
+		reason, err := stoppedTaskReason(awsConn, clusterName, serviceName, deploymentId)
+		if err != nil {
+			return err
+		}
+		if reason != "" {
+			return &DeploymentError{Reason: reason}
+		}
+
+		var progress = fmt.Sprintf("%d/%d running, %d pending; %d older deployment(s) draining with %d running task(s)",
+			*primary.RunningCount, *primary.DesiredCount, *primary.PendingCount, draining, drainingTasks)
+		if progress != lastProgress {
+			fmt.Printf("     [%s] %s\n", time.Since(started).Truncate(time.Second), progress)
+			lastProgress = progress
+		}
+		if *primary.RunningCount == *primary.DesiredCount && draining == 0 {
+			return nil
+		}
+
+		var remaining = time.Until(deadline)
+		if remaining <= 0 {
+			return &DeploymentError{Reason: fmt.Sprintf("timed out after %s waiting for the deployment (%s)", timeout, progress)}
+		}
+		// Don't sleep past the deadline, so that the timeout isn't overshot by up to a poll interval.
+		if remaining > deploymentPollInterval {
+			remaining = deploymentPollInterval
+		}
+		time.Sleep(remaining)
+	}
+}
+
+//
+// Look for stopped tasks that the deployment with the given ID started, which means the new tasks are failing. ECS
+// records the deployment's ID as the startedBy of the tasks it starts. Returns a description of the first one found, or
+// an empty string if there are none.
+//
+func stoppedTaskReason(awsConn ecsiface.ECSAPI, clusterName string, serviceName string, deploymentId string) (string, error) {
+	tasks, err := getStoppedServiceTasks(awsConn, clusterName, serviceName)
+	if err != nil {
+		return "", err
+	}
+	for _, task := range tasks {
+		if aws.StringValue(task.StartedBy) != deploymentId {
+			continue
+		}
+		var reason = fmt.Sprintf("task %s stopped", getRevisionFromTaskDefinition(*task.TaskArn))
+		if task.StoppedReason != nil {
+			reason += ": " + *task.StoppedReason
+		}
+		for _, container := range newStoppedTask(task).Containers {
+			if container.Reason != "" || (container.ExitCode != nil && *container.ExitCode != 0) {
+				reason += " (" + container.description() + ")"
+			}
+		}
+		return reason, nil
+	}
+	return "", nil
+}
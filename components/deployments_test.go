@@ -0,0 +1,53 @@
+package components
+
+import str "strings"
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+func TestWaitForDeploymentStoppedTasks(t *testing.T) {
+	tests := []struct {
+		startedBy string
+		reason    string // Expected in the DeploymentError, or empty if the deployment settles
+	}{
+		{"ecs-svc/0", ""}, // Stopped by an earlier deployment
+		{"ecs-svc/1", "task 1 stopped: Essential container in task exited (container api exited with code 1)"},
+	}
+	for _, test := range tests {
+		fake := newFakeECS()
+		current := fake.addTaskDefinition("api", fakeContainer("api", "acme/api:v1"))
+		fake.addService("api", current, 1)
+		fake.addStoppedTask("api", current, time.Minute, "Essential container in task exited",
+			&ecs.Container{Name: aws.String("api"), ExitCode: aws.Int64(1)}).StartedBy = aws.String(test.startedBy)
+
+		_, err := UpdateService(fake.clients(), "prod", "api", []string{":v2"}, time.Minute, false, false)
+		var deploymentErr *DeploymentError
+		switch {
+		case test.reason == "" && err != nil:
+			t.Errorf("task started by %s failed the deployment: %v", test.startedBy, err)
+		case test.reason != "" && (!errors.As(err, &deploymentErr) || deploymentErr.Reason != test.reason):
+			t.Errorf("task started by %s returned %v, want a DeploymentError %q", test.startedBy, err, test.reason)
+		}
+	}
+}
+
+func TestWaitForDeploymentTimeout(t *testing.T) {
+	fake := newFakeECS()
+	fake.addService("api", fake.addTaskDefinition("api", fakeContainer("api", "acme/api:v1")), 1)
+	fake.unsettled = true
+
+	var started = time.Now()
+	_, err := UpdateService(fake.clients(), "prod", "api", []string{":v2"}, 100*time.Millisecond, false, false)
+	var deploymentErr *DeploymentError
+	if !errors.As(err, &deploymentErr) || !str.Contains(deploymentErr.Reason, "timed out") {
+		t.Errorf("returned %v, want a DeploymentError for the timeout", err)
+	}
+	if elapsed := time.Since(started); elapsed > deploymentPollInterval/2 {
+		t.Errorf("took %s to time out after 100ms", elapsed)
+	}
+}
@@ -9,47 +9,129 @@ import (
 	"fmt"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/elb"
+	"github.com/aws/aws-sdk-go/service/elb/elbiface"
 )
 
 //
-// Takes a list of ELB names, retrieves their details and prints.
+// LoadBalancerInfo describes a classic ELB, the instances registered with it and their health, and its backend servers.
 //
-func PrintElbs(creds *credentials.Credentials, region string, loadBalancers []*string) {
-	if len(loadBalancers) > 0 {
+type LoadBalancerInfo struct {
+	Name           string               `json:"name"`
+	DNSName        string               `json:"dnsName"`
+	Instances      []string             `json:"instances"`
+	InstanceHealth []InstanceHealthInfo `json:"instanceHealth"`
+	BackendServers []BackendServerInfo  `json:"backendServers"`
+}
+
+//
+// InstanceHealthInfo is the health of an instance registered with a classic ELB. State is InService, OutOfService or
+// Unknown, and the reason code and description say why when it isn't InService.
+//
+type InstanceHealthInfo struct {
+	InstanceId  string `json:"instanceId"`
+	State       string `json:"state"`
+	ReasonCode  string `json:"reasonCode,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// BackendServerInfo is a backend server port of an ELB and the policies that apply to it.
+type BackendServerInfo struct {
+	InstancePort int64    `json:"instancePort"`
+	PolicyNames  []string `json:"policyNames"`
+}
+
+//
+// Takes a list of ELB names and retrieves their details, including the health of each registered instance.
+//
+func GetLoadBalancers(clients *Clients, loadBalancers []*string) ([]LoadBalancerInfo, error) {
+	var balancers = make([]LoadBalancerInfo, 0)
+	if len(loadBalancers) == 0 {
+		return balancers, nil
+	}
+	balancerInfo, err := GetElbData(clients, loadBalancers)
+	if err != nil {
+		return nil, err
+	}
+	for _, balancer := range balancerInfo.LoadBalancerDescriptions {
+		info := LoadBalancerInfo{
+			Name:           *balancer.LoadBalancerName,
+			DNSName:        *balancer.DNSName,
+			Instances:      []string{},
+			BackendServers: []BackendServerInfo{},
+		}
+		for _, instance := range balancer.Instances {
+			info.Instances = append(info.Instances, *instance.InstanceId)
+		}
+		for _, backend := range balancer.BackendServerDescriptions {
+			info.BackendServers = append(info.BackendServers, BackendServerInfo{
+				InstancePort: *backend.InstancePort,
+				PolicyNames:  aws.StringValueSlice(backend.PolicyNames),
+			})
+		}
+		if info.InstanceHealth, err = getInstanceHealth(clients.ELB, info.Name); err != nil {
+			return nil, err
+		}
+		balancers = append(balancers, info)
+	}
+	return balancers, nil
+}
+
+//
+// Prints the ELB details fetched by GetLoadBalancers.
+//
+func PrintElbs(balancers []LoadBalancerInfo) {
+	if len(balancers) > 0 {
 		fmt.Println("")
 		PrintSeparator()
-		balancerInfo := GetElbData(creds, region, loadBalancers)
-		for _, balancer := range balancerInfo.LoadBalancerDescriptions {
-			fmt.Println("  Load Balancer:", *balancer.LoadBalancerName)
-			fmt.Println("  - DNSName:", *balancer.DNSName)
-			for _, instance := range balancer.Instances {
-				fmt.Println("  - Instance:", *instance.InstanceId)
+		for _, balancer := range balancers {
+			fmt.Println("  Load Balancer:", balancer.Name)
+			fmt.Println("  - DNSName:", balancer.DNSName)
+			for _, instance := range balancer.InstanceHealth {
+				fmt.Println("  - Instance:", instance.InstanceId, instance.State)
+				if instance.State != elbInstanceInService && instance.Description != "" {
+					fmt.Printf("    %s: %s\n", instance.ReasonCode, instance.Description)
+				}
 			}
-			for _, backend := range balancer.BackendServerDescriptions {
-				fmt.Println("  - Backend server port:", *backend.InstancePort)
-				fmt.Println("  - Backend server:", backend.String())
+			for _, backend := range balancer.BackendServers {
+				fmt.Println("  - Backend server port:", backend.InstancePort)
+				fmt.Println("  - Backend server policies:", backend.PolicyNames)
 			}
 		}
 	}
 }
 
 //
-// Fetch ELB data
+// Fetch ELB data for the named load balancers, a batch at a time since DescribeLoadBalancers takes at most 20 names.
 //
-func GetElbData(creds *credentials.Credentials, region string, loadBalancers []*string) *elb.DescribeLoadBalancersOutput {
-	// We need to get a new client because the "ELB" service is different from the "ECS" service.
-	elbAwsConn := elb.New(session.New(), &aws.Config{
-		Region:      aws.String(region),
-		Credentials: creds,
-	})
-
+func GetElbData(clients *Clients, loadBalancers []*string) (*elb.DescribeLoadBalancersOutput, error) {
 	// Fetch the details given the list of ELBs.
-	balancerInfo, err := elbAwsConn.DescribeLoadBalancers(&elb.DescribeLoadBalancersInput{
-		LoadBalancerNames: loadBalancers,
-	})
-	CheckError("fetching load balancer data", err)
-	return balancerInfo
+	descriptions, err := describeLoadBalancers(clients.ELB, loadBalancers)
+	if err != nil {
+		return nil, err
+	}
+	return &elb.DescribeLoadBalancersOutput{LoadBalancerDescriptions: descriptions}, nil
+}
+
+/////////////// Private functions
+
+// The state of a healthy instance registered with a classic ELB. The SDK doesn't define constants for them.
+const elbInstanceInService = "InService"
+
+// Fetch the health of every instance registered with a classic ELB.
+func getInstanceHealth(elbConn elbiface.ELBAPI, loadBalancerName string) ([]InstanceHealthInfo, error) {
+	output, err := elbConn.DescribeInstanceHealth(&elb.DescribeInstanceHealthInput{LoadBalancerName: &loadBalancerName})
+	if err != nil {
+		return nil, apiError(fmt.Sprintf("fetching instance health for %s", loadBalancerName), err)
+	}
+	var instances = make([]InstanceHealthInfo, 0)
+	for _, state := range output.InstanceStates {
+		instances = append(instances, InstanceHealthInfo{
+			InstanceId:  aws.StringValue(state.InstanceId),
+			State:       aws.StringValue(state.State),
+			ReasonCode:  aws.StringValue(state.ReasonCode),
+			Description: aws.StringValue(state.Description),
+		})
+	}
+	return instances, nil
 }
@@ -0,0 +1,80 @@
+/*
+The kinds of error the operations return, so that callers can tell them apart with errors.As and decide what to do.
+
+Womply, www.womply.com
+*/
+package components
+
+import str "strings"
+import "fmt"
+
+//
+// NotFoundError means a cluster, service, task definition or other resource that was asked for doesn't exist.
+//
+type NotFoundError struct {
+	Kind string // What was looked for, such as "service"
+	Name string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("%s %s not found", e.Kind, e.Name)
+}
+
+//
+// ValidationError means the input, such as a task file, a template variable or a command-line value, is wrong. The
+// message says what was wrong with it and Problems, if there is more than one thing, lists them.
+//
+type ValidationError struct {
+	Message  string
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	if len(e.Problems) == 0 {
+		return e.Message
+	}
+	return e.Message + ":\n  - " + str.Join(e.Problems, "\n  - ")
+}
+
+//
+// APIError means a call to AWS failed, after any retries. Err is the error the SDK returned, which can be examined with
+// errors.As for the awserr.Error details.
+//
+type APIError struct {
+	Action string // What was being done, such as "fetching clusters list"
+	Err    error
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Action, e.Err)
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+//
+// DeploymentError means a service deployment didn't reach a steady state. RolledBackTo is the task definition the
+// service was pointed back at, if it was rolled back.
+//
+type DeploymentError struct {
+	Reason       string
+	RolledBackTo string
+}
+
+func (e *DeploymentError) Error() string {
+	if e.RolledBackTo != "" {
+		return fmt.Sprintf("deployment failed: %s (rolled back to %s)", e.Reason, getRevisionFromTaskDefinition(e.RolledBackTo))
+	}
+	return "deployment failed: " + e.Reason
+}
+
+/////////////// Private functions
+
+// Wrap an error from an AWS call in an APIError, or return nil if there wasn't one.
+func apiError(action string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &APIError{Action: action, Err: err}
+}
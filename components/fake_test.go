@@ -0,0 +1,520 @@
+/*
+In-memory stand-ins for ECS and the load balancers, so that the operations can be tested without an AWS account.
+
+Womply, www.womply.com
+*/
+package components
+
+import str "strings"
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+	"github.com/aws/aws-sdk-go/service/elb"
+	"github.com/aws/aws-sdk-go/service/elb/elbiface"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+)
+
+const fakeArnPrefix = "arn:aws:ecs:us-west-2:123456789012:"
+
+//
+// fakeECS holds services, task definitions and tasks in memory and answers the calls the operations make about them.
+// Any other call panics on the nil embedded interface, which shows up a test that needs more of the fake. Listings
+// come back pageSize items at a time so that paging is exercised too. Services are added to the cluster named by
+// cluster, and their names have to be unique across clusters.
+//
+type fakeECS struct {
+	ecsiface.ECSAPI
+
+	pageSize        int
+	cluster         string
+	clusters        []string
+	services        map[string]*ecs.Service // By name
+	taskDefinitions []*ecs.TaskDefinition   // In the order they were registered
+	tags            map[string][]*ecs.Tag   // By task definition ARN
+	tasks           []*ecs.Task
+	instances       map[string]string // EC2 instance IDs by container instance ARN
+	unsettled       bool              // Deployments never get any tasks running
+
+	elb   *fakeELB // The load balancers the services use
+	elbv2 *fakeELBV2
+
+	// What was asked of the fake, for the tests to check.
+	registered []*ecs.RegisterTaskDefinitionInput
+	updated    []*ecs.UpdateServiceInput
+}
+
+func newFakeECS() *fakeECS {
+	return &fakeECS{
+		pageSize:  2,
+		cluster:   "prod",
+		services:  map[string]*ecs.Service{},
+		tags:      map[string][]*ecs.Tag{},
+		instances: map[string]string{},
+		elb:       &fakeELB{health: map[string][]*elb.InstanceState{}},
+		elbv2:     &fakeELBV2{targets: map[string][]*elbv2.TargetHealthDescription{}},
+	}
+}
+
+// Make Clients that use the fakes.
+func (fake *fakeECS) clients() *Clients {
+	return &Clients{ECS: fake, ELB: fake.elb, ELBV2: fake.elbv2}
+}
+
+// Register a revision of a task definition family with the given containers, and return its ARN.
+func (fake *fakeECS) addTaskDefinition(family string, containers ...*ecs.ContainerDefinition) string {
+	output, _ := fake.RegisterTaskDefinition(&ecs.RegisterTaskDefinitionInput{
+		Family:               aws.String(family),
+		ContainerDefinitions: containers,
+	})
+	fake.registered = nil // Only record what the code under test registers
+	return *output.TaskDefinition.TaskDefinitionArn
+}
+
+// Add an active service running the given task definition to the current cluster.
+func (fake *fakeECS) addService(name string, taskDefinitionArn string, desiredCount int64) {
+	if fake.findCluster(fake.cluster) == "" {
+		fake.clusters = append(fake.clusters, fake.cluster)
+	}
+	fake.services[name] = &ecs.Service{
+		ServiceName:    aws.String(name),
+		ServiceArn:     aws.String(fakeArnPrefix + "service/" + fake.cluster + "/" + name),
+		ClusterArn:     aws.String(fakeArnPrefix + "cluster/" + fake.cluster),
+		Status:         aws.String("ACTIVE"),
+		TaskDefinition: aws.String(taskDefinitionArn),
+		DesiredCount:   aws.Int64(desiredCount),
+		RunningCount:   aws.Int64(desiredCount),
+		PendingCount:   aws.Int64(0),
+	}
+}
+
+// Add a task of a service, running the given task definition, with the given last status. Returns the task, so that
+// a test can fill in more of it.
+func (fake *fakeECS) addTask(serviceName string, taskDefinitionArn string, lastStatus string) *ecs.Task {
+	var desiredStatus = "RUNNING"
+	if lastStatus == "STOPPED" {
+		desiredStatus = "STOPPED"
+	}
+	task := &ecs.Task{
+		TaskArn:           aws.String(fmt.Sprintf("%stask/%d", fakeArnPrefix, len(fake.tasks)+1)),
+		TaskDefinitionArn: aws.String(taskDefinitionArn),
+		Group:             aws.String("service:" + serviceName),
+		DesiredStatus:     aws.String(desiredStatus),
+		LastStatus:        aws.String(lastStatus),
+	}
+	fake.tasks = append(fake.tasks, task)
+	return task
+}
+
+// Add an awsvpc task of a service with the given private IP address.
+func (fake *fakeECS) addTaskWithIP(serviceName string, taskDefinitionArn string, ip string) {
+	fake.addTask(serviceName, taskDefinitionArn, "RUNNING").Containers = []*ecs.Container{{
+		Name:              aws.String("api"),
+		NetworkInterfaces: []*ecs.NetworkInterface{{PrivateIpv4Address: aws.String(ip)}},
+	}}
+}
+
+// Add a task of a service running on an EC2 instance, with its container bound to the given host port.
+func (fake *fakeECS) addTaskOnInstance(serviceName string, taskDefinitionArn string, instanceId string, hostPort int64) {
+	containerInstanceArn := fakeArnPrefix + "container-instance/" + fake.cluster + "/" + instanceId
+	fake.instances[containerInstanceArn] = instanceId
+	task := fake.addTask(serviceName, taskDefinitionArn, "RUNNING")
+	task.ContainerInstanceArn = aws.String(containerInstanceArn)
+	task.Containers = []*ecs.Container{{
+		Name:            aws.String("api"),
+		NetworkBindings: []*ecs.NetworkBinding{{ContainerPort: aws.Int64(8080), HostPort: aws.Int64(hostPort)}},
+	}}
+}
+
+// Add a stopped task of a service that stopped the given time ago for the given reason, with its containers. Returns
+// the task, so that a test can fill in more of it.
+func (fake *fakeECS) addStoppedTask(serviceName string, taskDefinitionArn string, ago time.Duration,
+	reason string, containers ...*ecs.Container) *ecs.Task {
+	task := fake.addTask(serviceName, taskDefinitionArn, "STOPPED")
+	stoppedAt := time.Now().Add(-ago)
+	task.StoppedAt = &stoppedAt
+	if reason != "" {
+		task.StoppedReason = aws.String(reason)
+	}
+	task.Containers = containers
+	return task
+}
+
+func (fake *fakeECS) ListClustersPages(input *ecs.ListClustersInput, fn func(*ecs.ListClustersOutput, bool) bool) error {
+	var arns []*string
+	for _, cluster := range fake.clusters {
+		arns = append(arns, aws.String(fakeArnPrefix+"cluster/"+cluster))
+	}
+	fake.pages(len(arns), func(start int, end int, last bool) bool {
+		return fn(&ecs.ListClustersOutput{ClusterArns: arns[start:end]}, last)
+	})
+	return nil
+}
+
+func (fake *fakeECS) ListServicesPages(input *ecs.ListServicesInput, fn func(*ecs.ListServicesOutput, bool) bool) error {
+	cluster := fake.findCluster(*input.Cluster)
+	if cluster == "" {
+		return awserr.New(ecs.ErrCodeClusterNotFoundException, "Cluster not found.", nil)
+	}
+	var arns []*string
+	for _, service := range fake.sortedServices() {
+		if *service.ClusterArn == cluster {
+			arns = append(arns, service.ServiceArn)
+		}
+	}
+	fake.pages(len(arns), func(start int, end int, last bool) bool {
+		return fn(&ecs.ListServicesOutput{ServiceArns: arns[start:end]}, last)
+	})
+	return nil
+}
+
+func (fake *fakeECS) DescribeServices(input *ecs.DescribeServicesInput) (*ecs.DescribeServicesOutput, error) {
+	cluster := fake.findCluster(*input.Cluster)
+	if cluster == "" {
+		return nil, awserr.New(ecs.ErrCodeClusterNotFoundException, "Cluster not found.", nil)
+	}
+	output := &ecs.DescribeServicesOutput{}
+	for _, name := range input.Services {
+		name := aws.String((*name)[str.LastIndex(*name, "/")+1:]) // Services can be given by ARN
+		if service, found := fake.services[*name]; found && *service.ClusterArn == cluster {
+			output.Services = append(output.Services, service)
+		} else {
+			output.Failures = append(output.Failures, &ecs.Failure{Arn: name, Reason: aws.String("MISSING")})
+		}
+	}
+	return output, nil
+}
+
+func (fake *fakeECS) DescribeTaskDefinition(input *ecs.DescribeTaskDefinitionInput) (*ecs.DescribeTaskDefinitionOutput, error) {
+	taskDef := fake.findTaskDefinition(*input.TaskDefinition)
+	if taskDef == nil {
+		return nil, awserr.New(ecs.ErrCodeClientException, "Unable to describe task definition.", nil)
+	}
+	// Hand out copies of the containers, since callers change them.
+	copied := *taskDef
+	copied.ContainerDefinitions = nil
+	for _, container := range taskDef.ContainerDefinitions {
+		containerCopy := *container
+		copied.ContainerDefinitions = append(copied.ContainerDefinitions, &containerCopy)
+	}
+	output := &ecs.DescribeTaskDefinitionOutput{TaskDefinition: &copied}
+	for _, include := range input.Include {
+		if *include == ecs.TaskDefinitionFieldTags {
+			output.Tags = fake.tags[*taskDef.TaskDefinitionArn]
+		}
+	}
+	return output, nil
+}
+
+func (fake *fakeECS) RegisterTaskDefinition(input *ecs.RegisterTaskDefinitionInput) (*ecs.RegisterTaskDefinitionOutput, error) {
+	fake.registered = append(fake.registered, input)
+	var revision int64 = 1
+	for _, taskDef := range fake.taskDefinitions {
+		if *taskDef.Family == *input.Family {
+			revision = *taskDef.Revision + 1
+		}
+	}
+	taskDef := &ecs.TaskDefinition{
+		TaskDefinitionArn:    aws.String(fmt.Sprintf("%stask-definition/%s:%d", fakeArnPrefix, *input.Family, revision)),
+		Family:               input.Family,
+		Revision:             aws.Int64(revision),
+		Status:               aws.String(ecs.TaskDefinitionStatusActive),
+		ContainerDefinitions: input.ContainerDefinitions,
+	}
+	fake.taskDefinitions = append(fake.taskDefinitions, taskDef)
+	fake.tags[*taskDef.TaskDefinitionArn] = input.Tags
+	return &ecs.RegisterTaskDefinitionOutput{TaskDefinition: taskDef, Tags: input.Tags}, nil
+}
+
+func (fake *fakeECS) UpdateService(input *ecs.UpdateServiceInput) (*ecs.UpdateServiceOutput, error) {
+	fake.updated = append(fake.updated, input)
+	service, found := fake.services[*input.Service]
+	if !found {
+		return nil, awserr.New(ecs.ErrCodeServiceNotFoundException, "Service not found.", nil)
+	}
+	if input.TaskDefinition != nil {
+		service.TaskDefinition = aws.String(*fake.findTaskDefinition(*input.TaskDefinition).TaskDefinitionArn)
+		// The deployment settles straight away unless the fake is told otherwise, so that waiting for it doesn't
+		// have to poll.
+		var running = *service.DesiredCount
+		if fake.unsettled {
+			running = 0
+		}
+		service.Deployments = []*ecs.Deployment{{
+			Id:             aws.String(fmt.Sprintf("ecs-svc/%d", len(fake.updated))),
+			Status:         aws.String("PRIMARY"),
+			TaskDefinition: service.TaskDefinition,
+			DesiredCount:   service.DesiredCount,
+			RunningCount:   aws.Int64(running),
+			PendingCount:   aws.Int64(0),
+		}}
+	}
+	return &ecs.UpdateServiceOutput{Service: service}, nil
+}
+
+func (fake *fakeECS) ListTaskDefinitionsPages(input *ecs.ListTaskDefinitionsInput,
+	fn func(*ecs.ListTaskDefinitionsOutput, bool) bool) error {
+	var arns []*string
+	for _, taskDef := range fake.taskDefinitions {
+		if input.FamilyPrefix == nil || str.HasPrefix(*taskDef.Family, *input.FamilyPrefix) {
+			arns = append(arns, taskDef.TaskDefinitionArn)
+		}
+	}
+	fake.pages(len(arns), func(start int, end int, last bool) bool {
+		return fn(&ecs.ListTaskDefinitionsOutput{TaskDefinitionArns: arns[start:end]}, last)
+	})
+	return nil
+}
+
+func (fake *fakeECS) ListTasksPages(input *ecs.ListTasksInput, fn func(*ecs.ListTasksOutput, bool) bool) error {
+	var arns []*string
+	for _, task := range fake.tasks {
+		if input.ServiceName != nil && *task.Group != "service:"+*input.ServiceName {
+			continue
+		}
+		var desiredStatus = "RUNNING" // What ECS lists when no status is given
+		if input.DesiredStatus != nil {
+			desiredStatus = *input.DesiredStatus
+		}
+		if *task.DesiredStatus == desiredStatus {
+			arns = append(arns, task.TaskArn)
+		}
+	}
+	fake.pages(len(arns), func(start int, end int, last bool) bool {
+		return fn(&ecs.ListTasksOutput{TaskArns: arns[start:end]}, last)
+	})
+	return nil
+}
+
+func (fake *fakeECS) DescribeTasks(input *ecs.DescribeTasksInput) (*ecs.DescribeTasksOutput, error) {
+	if len(input.Tasks) > describeTasksBatch {
+		return nil, awserr.New(ecs.ErrCodeInvalidParameterException, "Too many tasks.", nil)
+	}
+	output := &ecs.DescribeTasksOutput{}
+	for _, arn := range input.Tasks {
+		for _, task := range fake.tasks {
+			if *task.TaskArn == *arn {
+				output.Tasks = append(output.Tasks, task)
+			}
+		}
+	}
+	return output, nil
+}
+
+func (fake *fakeECS) DescribeContainerInstances(input *ecs.DescribeContainerInstancesInput) (*ecs.DescribeContainerInstancesOutput, error) {
+	if len(input.ContainerInstances) > describeInstancesBatch {
+		return nil, awserr.New(ecs.ErrCodeInvalidParameterException, "Too many container instances.", nil)
+	}
+	output := &ecs.DescribeContainerInstancesOutput{}
+	for _, arn := range input.ContainerInstances {
+		if instanceId, found := fake.instances[*arn]; found {
+			output.ContainerInstances = append(output.ContainerInstances, &ecs.ContainerInstance{
+				ContainerInstanceArn: arn,
+				Ec2InstanceId:        aws.String(instanceId),
+			})
+		}
+	}
+	return output, nil
+}
+
+// Find a cluster by its name or ARN, and return its ARN, or an empty string if there's no such cluster.
+func (fake *fakeECS) findCluster(name string) string {
+	for _, cluster := range fake.clusters {
+		if arn := fakeArnPrefix + "cluster/" + cluster; name == cluster || name == arn {
+			return arn
+		}
+	}
+	return ""
+}
+
+// The services in order of name, so that listings come back in a fixed order.
+func (fake *fakeECS) sortedServices() []*ecs.Service {
+	var names []string
+	for name := range fake.services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var services []*ecs.Service
+	for _, name := range names {
+		services = append(services, fake.services[name])
+	}
+	return services
+}
+
+// Find a task definition by its ARN or family:revision.
+func (fake *fakeECS) findTaskDefinition(name string) *ecs.TaskDefinition {
+	for _, taskDef := range fake.taskDefinitions {
+		if *taskDef.TaskDefinitionArn == name || getRevisionFromTaskDefinition(*taskDef.TaskDefinitionArn) == name {
+			return taskDef
+		}
+	}
+	return nil
+}
+
+// Call page with the bounds of each page of a listing of count items, until it returns false.
+func (fake *fakeECS) pages(count int, page func(start int, end int, last bool) bool) {
+	for start := 0; start == 0 || start < count; start += fake.pageSize {
+		end := start + fake.pageSize
+		if end > count {
+			end = count
+		}
+		if !page(start, end, end == count) {
+			return
+		}
+	}
+}
+
+// A container definition with just a name and an image.
+func fakeContainer(name string, image string) *ecs.ContainerDefinition {
+	return &ecs.ContainerDefinition{Name: aws.String(name), Image: aws.String(image)}
+}
+
+//
+// fakeELB holds classic load balancers and the health of the instances registered with them. Like fakeECS, calls it
+// doesn't implement panic.
+//
+type fakeELB struct {
+	elbiface.ELBAPI
+
+	balancers []*elb.LoadBalancerDescription
+	health    map[string][]*elb.InstanceState // By load balancer name
+}
+
+//
+// Add a classic ELB with the given instances registered, each given as an instance ID and its state, such as
+// "i-0a1b2c3d=InService". Instances that are OutOfService failed their health checks.
+//
+func (fake *fakeELB) addLoadBalancer(name string, instances ...string) {
+	balancer := &elb.LoadBalancerDescription{
+		LoadBalancerName: aws.String(name),
+		DNSName:          aws.String(name + "-1234567890.us-west-2.elb.amazonaws.com"),
+	}
+	fake.health[name] = []*elb.InstanceState{}
+	for _, instance := range instances {
+		parts := str.SplitN(instance, "=", 2)
+		balancer.Instances = append(balancer.Instances, &elb.Instance{InstanceId: aws.String(parts[0])})
+		state := &elb.InstanceState{InstanceId: aws.String(parts[0]), State: aws.String(parts[1]), ReasonCode: aws.String("N/A"),
+			Description: aws.String("N/A")}
+		if parts[1] == "OutOfService" {
+			state.ReasonCode = aws.String("Instance")
+			state.Description = aws.String("Instance has failed at least the UnhealthyThreshold number of health checks consecutively.")
+		}
+		fake.health[name] = append(fake.health[name], state)
+	}
+	fake.balancers = append(fake.balancers, balancer)
+}
+
+func (fake *fakeELB) DescribeLoadBalancers(input *elb.DescribeLoadBalancersInput) (*elb.DescribeLoadBalancersOutput, error) {
+	if len(input.LoadBalancerNames) > describeLoadBalancersBatch {
+		return nil, awserr.New("ValidationError", "Too many load balancers.", nil)
+	}
+	output := &elb.DescribeLoadBalancersOutput{}
+	for _, name := range input.LoadBalancerNames {
+		for _, balancer := range fake.balancers {
+			if *balancer.LoadBalancerName == *name {
+				output.LoadBalancerDescriptions = append(output.LoadBalancerDescriptions, balancer)
+			}
+		}
+	}
+	return output, nil
+}
+
+func (fake *fakeELB) DescribeInstanceHealth(input *elb.DescribeInstanceHealthInput) (*elb.DescribeInstanceHealthOutput, error) {
+	states, found := fake.health[*input.LoadBalancerName]
+	if !found {
+		return nil, awserr.New(elb.ErrCodeAccessPointNotFoundException, "There is no ACTIVE Load Balancer named '"+
+			*input.LoadBalancerName+"'", nil)
+	}
+	return &elb.DescribeInstanceHealthOutput{InstanceStates: states}, nil
+}
+
+//
+// fakeELBV2 holds application load balancers, their target groups and the targets registered with them. Like
+// fakeECS, calls it doesn't implement panic.
+//
+type fakeELBV2 struct {
+	elbv2iface.ELBV2API
+
+	loadBalancers []*elbv2.LoadBalancer
+	targetGroups  []*elbv2.TargetGroup
+	targets       map[string][]*elbv2.TargetHealthDescription // By target group ARN
+}
+
+//
+// Add a target group for HTTP on port 80, behind an application load balancer of the same name, with IP targets on
+// port 8080 in the given states. Returns the target group's ARN.
+//
+func (fake *fakeELBV2) addTargetGroup(name string, states ...string) string {
+	balancerArn := "arn:aws:elasticloadbalancing:us-west-2:123456789012:loadbalancer/app/" + name + "/50dc6c495c0c9188"
+	fake.loadBalancers = append(fake.loadBalancers, &elbv2.LoadBalancer{
+		LoadBalancerArn:  aws.String(balancerArn),
+		LoadBalancerName: aws.String(name),
+		DNSName:          aws.String(name + "-1234567890.us-west-2.elb.amazonaws.com"),
+		Type:             aws.String(elbv2.LoadBalancerTypeEnumApplication),
+		Scheme:           aws.String(elbv2.LoadBalancerSchemeEnumInternetFacing),
+		State:            &elbv2.LoadBalancerState{Code: aws.String(elbv2.LoadBalancerStateEnumActive)},
+	})
+	arn := "arn:aws:elasticloadbalancing:us-west-2:123456789012:targetgroup/" + name + "/6d0ecf831eec9f09"
+	fake.targetGroups = append(fake.targetGroups, &elbv2.TargetGroup{
+		TargetGroupArn:   aws.String(arn),
+		TargetGroupName:  aws.String(name),
+		Protocol:         aws.String(elbv2.ProtocolEnumHttp),
+		Port:             aws.Int64(80),
+		TargetType:       aws.String(elbv2.TargetTypeEnumIp),
+		LoadBalancerArns: []*string{aws.String(balancerArn)},
+	})
+	fake.targets[arn] = []*elbv2.TargetHealthDescription{}
+	for index, state := range states {
+		description := &elbv2.TargetHealthDescription{
+			Target:       &elbv2.TargetDescription{Id: aws.String(fmt.Sprintf("10.0.1.%d", index+1)), Port: aws.Int64(8080)},
+			TargetHealth: &elbv2.TargetHealth{State: aws.String(state)},
+		}
+		if state == elbv2.TargetHealthStateEnumUnhealthy {
+			description.TargetHealth.Reason = aws.String(elbv2.TargetHealthReasonEnumTargetFailedHealthChecks)
+			description.TargetHealth.Description = aws.String("Health checks failed with these codes: [502]")
+		}
+		fake.targets[arn] = append(fake.targets[arn], description)
+	}
+	return arn
+}
+
+func (fake *fakeELBV2) DescribeTargetGroups(input *elbv2.DescribeTargetGroupsInput) (*elbv2.DescribeTargetGroupsOutput, error) {
+	output := &elbv2.DescribeTargetGroupsOutput{}
+	for _, arn := range input.TargetGroupArns {
+		for _, group := range fake.targetGroups {
+			if *group.TargetGroupArn == *arn {
+				output.TargetGroups = append(output.TargetGroups, group)
+			}
+		}
+	}
+	return output, nil
+}
+
+func (fake *fakeELBV2) DescribeLoadBalancers(input *elbv2.DescribeLoadBalancersInput) (*elbv2.DescribeLoadBalancersOutput, error) {
+	if len(input.LoadBalancerArns) > describeLoadBalancersBatch {
+		return nil, awserr.New("ValidationError", "Too many load balancers.", nil)
+	}
+	output := &elbv2.DescribeLoadBalancersOutput{}
+	for _, arn := range input.LoadBalancerArns {
+		for _, balancer := range fake.loadBalancers {
+			if *balancer.LoadBalancerArn == *arn {
+				output.LoadBalancers = append(output.LoadBalancers, balancer)
+			}
+		}
+	}
+	return output, nil
+}
+
+func (fake *fakeELBV2) DescribeTargetHealth(input *elbv2.DescribeTargetHealthInput) (*elbv2.DescribeTargetHealthOutput, error) {
+	targets, found := fake.targets[*input.TargetGroupArn]
+	if !found {
+		return nil, awserr.New(elbv2.ErrCodeTargetGroupNotFoundException, "Target group not found.", nil)
+	}
+	return &elbv2.DescribeTargetHealthOutput{TargetHealthDescriptions: targets}, nil
+}
@@ -0,0 +1,148 @@
+/*
+Functions for reading task definition files written in JSON or YAML.
+
+Womply, www.womply.com
+*/
+package components
+
+import str "strings"
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The formats a task definition file can be written in.
+const (
+	formatJSON = "json"
+	formatYAML = "yaml"
+)
+
+/////////////// Private functions
+
+//
+// Work out which format a task definition file is in. An explicit format wins, otherwise it goes by the file extension,
+// with .yaml and .yml meaning YAML and anything else JSON.
+//
+func taskFileFormat(taskFile string, format string) (string, error) {
+	switch str.ToLower(format) {
+	case formatJSON:
+		return formatJSON, nil
+	case formatYAML, "yml":
+		return formatYAML, nil
+	case "":
+		switch str.ToLower(filepath.Ext(taskFile)) {
+		case ".yaml", ".yml":
+			return formatYAML, nil
+		}
+		return formatJSON, nil
+	}
+	return "", &ValidationError{Message: fmt.Sprintf("unknown task file format %s - use json or yaml", format)}
+}
+
+//
+// Turn the contents of a task definition file into JSON, so that both formats are decoded and checked the same way.
+// YAML uses the same field names as JSON.
+//
+func taskFileJSON(fileBytes []byte, format string) ([]byte, error) {
+	if format != formatYAML {
+		return fileBytes, nil
+	}
+	var document interface{}
+	if err := yaml.Unmarshal(fileBytes, &document); err != nil {
+		return nil, err
+	}
+	document, err := jsonCompatible(document)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(document)
+}
+
+//
+// YAML allows mapping keys that aren't strings, which JSON doesn't, so convert any such maps and make sure their keys
+// are all strings.
+//
+func jsonCompatible(value interface{}) (interface{}, error) {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		for key, item := range typed {
+			converted, err := jsonCompatible(item)
+			if err != nil {
+				return nil, err
+			}
+			typed[key] = converted
+		}
+	case map[interface{}]interface{}:
+		converted := map[string]interface{}{}
+		for key, item := range typed {
+			keyString, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("mapping key %v is not a string", key)
+			}
+			convertedItem, err := jsonCompatible(item)
+			if err != nil {
+				return nil, err
+			}
+			converted[keyString] = convertedItem
+		}
+		return converted, nil
+	case []interface{}:
+		for index, item := range typed {
+			converted, err := jsonCompatible(item)
+			if err != nil {
+				return nil, err
+			}
+			typed[index] = converted
+		}
+	}
+	return value, nil
+}
+
+// Map the path of each key and list element in a task definition file to its line, whichever format it's in.
+func taskFileKeyLines(fileBytes []byte, format string) map[string]int {
+	if format == formatYAML {
+		return yamlKeyLines(fileBytes)
+	}
+	return jsonKeyLines(fileBytes)
+}
+
+//
+// Map the path of each key and list element in a YAML document, such as "containerdefinitions[0].image", to the line
+// it's on. Paths are lower-cased to match jsonKeyLines.
+//
+func yamlKeyLines(fileBytes []byte) map[string]int {
+	keyLines := map[string]int{}
+	var root yaml.Node
+	if yaml.Unmarshal(fileBytes, &root) != nil {
+		return keyLines
+	}
+	var walk func(node *yaml.Node, path string)
+	walk = func(node *yaml.Node, path string) {
+		switch node.Kind {
+		case yaml.DocumentNode:
+			for _, child := range node.Content {
+				walk(child, path)
+			}
+		case yaml.MappingNode:
+			for index := 0; index+1 < len(node.Content); index += 2 {
+				var keyPath = node.Content[index].Value
+				if path != "" {
+					keyPath = path + "." + keyPath
+				}
+				keyLines[str.ToLower(keyPath)] = node.Content[index].Line
+				walk(node.Content[index+1], keyPath)
+			}
+		case yaml.SequenceNode:
+			for index, child := range node.Content {
+				var elementPath = fmt.Sprintf("%s[%d]", path, index)
+				keyLines[str.ToLower(elementPath)] = child.Line
+				walk(child, elementPath)
+			}
+		}
+	}
+	walk(&root, "")
+	return keyLines
+}
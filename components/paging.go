@@ -0,0 +1,204 @@
+/*
+Functions that page through ECS listings and split describe calls into batches of the size the API accepts.
+
+Womply, www.womply.com
+*/
+package components
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+	"github.com/aws/aws-sdk-go/service/elb"
+	"github.com/aws/aws-sdk-go/service/elb/elbiface"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+)
+
+// The most ARNs or names each describe call accepts.
+const (
+	describeClustersBatch      = 100
+	describeServicesBatch      = 10
+	describeTasksBatch         = 100
+	describeInstancesBatch     = 100 // Container instances
+	describeLoadBalancersBatch = 20
+	describeTargetGroupsBatch  = 20 // For the elbv2 calls, which take ARNs
+)
+
+/////////////// Private functions
+
+// List the ARNs of all the clusters in the region.
+func listClusterArns(awsConn ecsiface.ECSAPI) ([]*string, error) {
+	var clusterArns []*string
+	err := awsConn.ListClustersPages(&ecs.ListClustersInput{}, func(page *ecs.ListClustersOutput, lastPage bool) bool {
+		clusterArns = append(clusterArns, page.ClusterArns...)
+		return true
+	})
+	return clusterArns, apiError("fetching clusters list", err)
+}
+
+// List the ARNs of all the services in a cluster. Returns a NotFoundError if there's no such cluster.
+func listServiceArns(awsConn ecsiface.ECSAPI, clusterName string) ([]*string, error) {
+	var serviceArns []*string
+	err := awsConn.ListServicesPages(&ecs.ListServicesInput{Cluster: &clusterName},
+		func(page *ecs.ListServicesOutput, lastPage bool) bool {
+			serviceArns = append(serviceArns, page.ServiceArns...)
+			return true
+		})
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == ecs.ErrCodeClusterNotFoundException {
+		return nil, &NotFoundError{Kind: "cluster", Name: clusterName}
+	}
+	return serviceArns, apiError(fmt.Sprintf("finding services for cluster %s", clusterName), err)
+}
+
+// List the ARNs of all the tasks matching the input, such as the tasks of one service with a given desired status.
+func listTaskArns(awsConn ecsiface.ECSAPI, input *ecs.ListTasksInput) ([]*string, error) {
+	var taskArns []*string
+	err := awsConn.ListTasksPages(input, func(page *ecs.ListTasksOutput, lastPage bool) bool {
+		taskArns = append(taskArns, page.TaskArns...)
+		return true
+	})
+	return taskArns, apiError("fetching task list", err)
+}
+
+// List the ARNs of all the task definitions matching the input, oldest revision first.
+func listTaskDefinitionArns(awsConn ecsiface.ECSAPI, input *ecs.ListTaskDefinitionsInput) ([]*string, error) {
+	var taskDefinitionArns []*string
+	err := awsConn.ListTaskDefinitionsPages(input, func(page *ecs.ListTaskDefinitionsOutput, lastPage bool) bool {
+		taskDefinitionArns = append(taskDefinitionArns, page.TaskDefinitionArns...)
+		return true
+	})
+	return taskDefinitionArns, apiError("fetching task definitions list", err)
+}
+
+// Describe the clusters with the given ARNs or names, in batches.
+func describeClusters(awsConn ecsiface.ECSAPI, clusters []*string) ([]*ecs.Cluster, error) {
+	var described []*ecs.Cluster
+	for _, batch := range batches(clusters, describeClustersBatch) {
+		output, err := awsConn.DescribeClusters(&ecs.DescribeClustersInput{Clusters: batch})
+		if err != nil {
+			return nil, apiError("fetching cluster data", err)
+		}
+		described = append(described, output.Clusters...)
+	}
+	return described, nil
+}
+
+// Describe the services in a cluster with the given ARNs or names, in batches. Returns a NotFoundError if there's no such
+// cluster.
+func describeServices(awsConn ecsiface.ECSAPI, clusterName string, services []*string) ([]*ecs.Service, error) {
+	var described []*ecs.Service
+	for _, batch := range batches(services, describeServicesBatch) {
+		output, err := awsConn.DescribeServices(&ecs.DescribeServicesInput{
+			Cluster:  &clusterName,
+			Services: batch,
+		})
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == ecs.ErrCodeClusterNotFoundException {
+			return nil, &NotFoundError{Kind: "cluster", Name: clusterName}
+		}
+		if err != nil {
+			return nil, apiError(fmt.Sprintf("fetching service data for cluster %s", clusterName), err)
+		}
+		described = append(described, output.Services...)
+	}
+	return described, nil
+}
+
+// Describe the tasks in a cluster with the given ARNs or IDs, in batches.
+func describeTasks(awsConn ecsiface.ECSAPI, clusterName string, tasks []*string) ([]*ecs.Task, error) {
+	var described []*ecs.Task
+	for _, batch := range batches(tasks, describeTasksBatch) {
+		output, err := awsConn.DescribeTasks(&ecs.DescribeTasksInput{
+			Cluster: &clusterName,
+			Tasks:   batch,
+		})
+		if err != nil {
+			return nil, apiError(fmt.Sprintf("fetching task data for cluster %s", clusterName), err)
+		}
+		described = append(described, output.Tasks...)
+	}
+	return described, nil
+}
+
+// Describe the container instances in a cluster with the given ARNs or IDs, in batches.
+func describeContainerInstances(awsConn ecsiface.ECSAPI, clusterName string, instances []*string) ([]*ecs.ContainerInstance, error) {
+	var described []*ecs.ContainerInstance
+	for _, batch := range batches(instances, describeInstancesBatch) {
+		output, err := awsConn.DescribeContainerInstances(&ecs.DescribeContainerInstancesInput{
+			Cluster:            &clusterName,
+			ContainerInstances: batch,
+		})
+		if err != nil {
+			return nil, apiError(fmt.Sprintf("fetching container instance data for cluster %s", clusterName), err)
+		}
+		described = append(described, output.ContainerInstances...)
+	}
+	return described, nil
+}
+
+// Describe the classic ELBs with the given names, in batches.
+func describeLoadBalancers(elbConn elbiface.ELBAPI, names []*string) ([]*elb.LoadBalancerDescription, error) {
+	var described []*elb.LoadBalancerDescription
+	for _, batch := range batches(names, describeLoadBalancersBatch) {
+		output, err := elbConn.DescribeLoadBalancers(&elb.DescribeLoadBalancersInput{LoadBalancerNames: batch})
+		if err != nil {
+			return nil, apiError("fetching load balancer data", err)
+		}
+		described = append(described, output.LoadBalancerDescriptions...)
+	}
+	return described, nil
+}
+
+// Describe the target groups with the given ARNs, in batches.
+func describeTargetGroups(elbv2Conn elbv2iface.ELBV2API, arns []*string) ([]*elbv2.TargetGroup, error) {
+	var described []*elbv2.TargetGroup
+	for _, batch := range batches(arns, describeTargetGroupsBatch) {
+		output, err := elbv2Conn.DescribeTargetGroups(&elbv2.DescribeTargetGroupsInput{TargetGroupArns: batch})
+		if err != nil {
+			return nil, apiError("fetching target group data", err)
+		}
+		described = append(described, output.TargetGroups...)
+	}
+	return described, nil
+}
+
+// Describe the application and network load balancers with the given ARNs, in batches.
+func describeLoadBalancersV2(elbv2Conn elbv2iface.ELBV2API, arns []*string) ([]*elbv2.LoadBalancer, error) {
+	var described []*elbv2.LoadBalancer
+	for _, batch := range batches(arns, describeLoadBalancersBatch) {
+		output, err := elbv2Conn.DescribeLoadBalancers(&elbv2.DescribeLoadBalancersInput{LoadBalancerArns: batch})
+		if err != nil {
+			return nil, apiError("fetching load balancer data", err)
+		}
+		described = append(described, output.LoadBalancers...)
+	}
+	return described, nil
+}
+
+// Drop repeated strings from a list, keeping the first of each, so that nothing is described twice.
+func uniqueStrings(items []*string) []*string {
+	var unique []*string
+	seen := map[string]bool{}
+	for _, item := range items {
+		if !seen[*item] {
+			seen[*item] = true
+			unique = append(unique, item)
+		}
+	}
+	return unique
+}
+
+// Split a list into consecutive batches of at most size items. An empty list gives no batches.
+func batches(items []*string, size int) [][]*string {
+	var split [][]*string
+	for start := 0; start < len(items); start += size {
+		end := start + size
+		if end > len(items) {
+			end = len(items)
+		}
+		split = append(split, items[start:end])
+	}
+	return split
+}
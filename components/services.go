@@ -7,214 +7,739 @@ package components
 
 import str "strings"
 import (
+	"errors"
 	"fmt"
-	"os"
+	"strconv"
+	"time"
 
-	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
 )
 
 //
-// Fetches and prints the information about the services. It also collects the names of the load balancers in use and
-// returns them so that the printElbs() function can use them if desired.
+// ClusterServices holds the services found in a cluster, along with the details of each.
 //
-func PrintServices(creds *credentials.Credentials,
-	region string,
+type ClusterServices struct {
+	Cluster       string             `json:"cluster"`
+	ServiceCount  int                `json:"serviceCount"`
+	Services      []ServiceInfo      `json:"services"`
+	LoadBalancers []LoadBalancerInfo `json:"loadBalancers,omitempty"`
+	TargetGroups  []TargetGroupInfo  `json:"targetGroups,omitempty"`
+}
+
+//
+// ServiceInfo describes a service: its counts, load balancers, deployments, tasks, recent events and the task
+// definition it runs.
+//
+type ServiceInfo struct {
+	Name                  string                `json:"name"`
+	Status                string                `json:"status"`
+	DesiredCount          int64                 `json:"desiredCount"`
+	RunningCount          int64                 `json:"runningCount"`
+	PendingCount          int64                 `json:"pendingCount"`
+	TaskDefinition        string                `json:"taskDefinition"`
+	LoadBalancers         []ServiceLoadBalancer `json:"loadBalancers"`
+	Deployments           []DeploymentInfo      `json:"deployments"`
+	Tasks                 []TaskInfo            `json:"tasks"`
+	Events                []EventInfo           `json:"events"`
+	LastEventAt           *time.Time            `json:"lastEventAt,omitempty"`
+	TaskDefinitionDetails *TaskDefinitionInfo   `json:"taskDefinitionDetails"`
+}
+
+//
+// ServiceLoadBalancer is a load balancer that a service registers one of its containers with. That's either a classic
+// ELB, by name, or the target group of an application or network load balancer, by ARN.
+//
+type ServiceLoadBalancer struct {
+	LoadBalancerName string `json:"loadBalancerName,omitempty"`
+	TargetGroupArn   string `json:"targetGroupArn,omitempty"`
+	ContainerName    string `json:"containerName"`
+	ContainerPort    int64  `json:"containerPort"`
+}
+
+// DeploymentInfo describes one of a service's deployments.
+type DeploymentInfo struct {
+	Id             string    `json:"id"`
+	Status         string    `json:"status"`
+	TaskDefinition string    `json:"taskDefinition"`
+	DesiredCount   int64     `json:"desiredCount"`
+	RunningCount   int64     `json:"runningCount"`
+	PendingCount   int64     `json:"pendingCount"`
+	CreatedAt      time.Time `json:"createdAt"`
+}
+
+// EventInfo is a service event. If the event is about a task, Task describes that task, if it could be found.
+type EventInfo struct {
+	CreatedAt time.Time `json:"createdAt"`
+	Message   string    `json:"message"`
+	TaskId    string    `json:"taskId,omitempty"`
+	Task      *TaskInfo `json:"task,omitempty"`
+}
+
+//
+// Fetches the information about the services in a cluster, or just the named service if serviceName isn't empty,
+// including up to eventCount of each service's most recent events. The details of up to concurrency services are
+// fetched at the same time, and the services come back in the order ECS describes them. Returns a NotFoundError if the
+// cluster doesn't exist or doesn't have the named service.
+//
+func GetServices(clients *Clients,
 	clusterName string,
 	serviceName string,
-	verboseFlag bool,
-	eventsFlag int) []*string {
+	eventCount int,
+	concurrency int) (*ClusterServices, error) {
 
-	var foundService = false
-
-	// Create a client connection object.
-	awsConn := GetEcsConnection(creds, region)
+	awsConn := clients.ECS
 
 	// Fetch the list of services in this cluster.
-	resp, err := awsConn.ListServices(&ecs.ListServicesInput{Cluster: &clusterName})
-	CheckError(fmt.Sprintf("finding services for cluster %s", clusterName), err)
+	serviceArns, err := listServiceArns(awsConn, clusterName)
+	if err != nil {
+		return nil, err
+	}
 
-	fmt.Println(len(resp.ServiceArns), "Services in cluster", clusterName)
+	clusterServices := &ClusterServices{
+		Cluster:      clusterName,
+		ServiceCount: len(serviceArns),
+		Services:     []ServiceInfo{},
+	}
 
 	// Retrieve the details given the list of services.
-	serviceInfo, err := awsConn.DescribeServices(&ecs.DescribeServicesInput{
-		Cluster:  &clusterName,
-		Services: resp.ServiceArns,
+	describedServices, err := describeServices(awsConn, clusterName, serviceArns)
+	if err != nil {
+		return nil, err
+	}
+	var services []*ecs.Service
+	for _, service := range describedServices {
+		// If a service name was passed in, only collect that service's info; skip the others
+		if (serviceName == "") || (serviceName == *service.ServiceName) {
+			services = append(services, service)
+		}
+	}
+	// Hmm, we didn't come across the service that was asked for.
+	if serviceName != "" && len(services) == 0 {
+		return nil, &NotFoundError{Kind: "service", Name: fmt.Sprintf("%s in cluster %s", serviceName, clusterName)}
+	}
+	clusterServices.Services = make([]ServiceInfo, len(services))
+	err = forEachConcurrently(len(services), concurrency, func(index int) error {
+		info, err := getServiceInfo(awsConn, clusterName, services[index], eventCount)
+		clusterServices.Services[index] = info
+		return err
 	})
-	CheckError(fmt.Sprintf("fetching service data for cluster %s", clusterName), err)
-
-	var loadBalancers = make([]*string, 0) // Collect the load balancers from each service
+	if err != nil {
+		return nil, err
+	}
+	return clusterServices, nil
+}
 
-	if len(serviceInfo.Services) == 0 {
+//
+// Prints the information about the services fetched by GetServices. Events are printed if there are any, and the
+// task definition details are printed in full if verboseFlag is set.
+//
+func PrintServices(clusterServices *ClusterServices, verboseFlag bool) {
+	fmt.Println(clusterServices.ServiceCount, "Services in cluster", clusterServices.Cluster)
+	if clusterServices.ServiceCount == 0 {
 		fmt.Println("  No services to describe.")
-	} else {
-		// Loop through and print information for each service
-		for _, service := range serviceInfo.Services {
-			// If a service name was passed in, only print that service's info; skip the others
-			if (serviceName == "") || (serviceName == *service.ServiceName) {
-				PrintSeparator()
-				fmt.Println("  Service:", *service.ServiceName)
-				fmt.Println("  - Running Count:", *service.RunningCount)
-				fmt.Println("  - Status:", *service.Status)
-				for _, balancer := range service.LoadBalancers {
-					loadBalancers = append(loadBalancers, balancer.LoadBalancerName) // Add to our list for returning
-					fmt.Println("  - Load Balancer:", *balancer.LoadBalancerName, "Port:", *balancer.ContainerPort)
-					fmt.Println("    Container Name:", *balancer.ContainerName)
-				}
-				for _, depl := range service.Deployments {
-					fmt.Println("  - Deployment:", *depl.Id, "Status:", *depl.Status)
-					fmt.Println("    Running instances:", *depl.RunningCount)
-				}
-				PrintServiceTasks(awsConn, clusterName, *service.ServiceName, *service.TaskDefinition)
-				if (eventsFlag > 0) && (len(service.Events) > 0) {
-					fmt.Printf("  - Events (most recent %d):\n", eventsFlag)
-					if len(service.Events) < 10 {
-						eventsFlag = len(service.Events)
-					}
-					for eventCount := 0; eventCount < eventsFlag; eventCount++ {
-						fmt.Printf("    At %s: %s\n", *service.Events[eventCount].CreatedAt, *service.Events[eventCount].Message)
-						//  Check if the message is about a task. If so, let's get the task ID and print info about the task
-						var eventMessage = *service.Events[eventCount].Message
-						var pos = str.Index(eventMessage, "(task ")
-						// If the message is about a task, let's print the basic info about the task
-						if pos != -1 {
-							var taskID = eventMessage[pos+6 : len(eventMessage)-2]
-							eventInfo, err := awsConn.DescribeTasks(&ecs.DescribeTasksInput{
-								Tasks:   []*string{&taskID},
-								Cluster: &clusterName,
-							})
-							CheckError(fmt.Sprintf("getting task data for %s\n", taskID), err)
-							if len(eventInfo.Tasks) < 1 {
-								fmt.Println("      Request for task data returned no results.")
-							} else {
-								fmt.Println("      Task:", *eventInfo.Tasks[0].TaskDefinitionArn)
-								fmt.Println("      Last known status:", *eventInfo.Tasks[0].LastStatus)
-							}
-						}
+		return
+	}
+	for _, service := range clusterServices.Services {
+		PrintSeparator()
+		fmt.Println("  Service:", service.Name)
+		fmt.Println("  - Running Count:", service.RunningCount)
+		fmt.Println("  - Status:", service.Status)
+		for _, balancer := range service.LoadBalancers {
+			if balancer.TargetGroupArn != "" {
+				fmt.Println("  - Target Group:", targetGroupName(balancer.TargetGroupArn), "Port:", balancer.ContainerPort)
+			} else {
+				fmt.Println("  - Load Balancer:", balancer.LoadBalancerName, "Port:", balancer.ContainerPort)
+			}
+			fmt.Println("    Container Name:", balancer.ContainerName)
+		}
+		for _, depl := range service.Deployments {
+			fmt.Println("  - Deployment:", depl.Id, "Status:", depl.Status)
+			fmt.Println("    Running instances:", depl.RunningCount)
+		}
+		printServiceTasks(service.Tasks)
+		if len(service.Events) > 0 {
+			fmt.Printf("  - Events (most recent %d):\n", len(service.Events))
+			for _, event := range service.Events {
+				fmt.Printf("    At %s: %s\n", event.CreatedAt, event.Message)
+				// If the message is about a task, print the basic info about the task
+				if event.TaskId != "" {
+					if event.Task == nil {
+						fmt.Println("      Request for task data returned no results.")
+					} else {
+						fmt.Println("      Task:", event.Task.TaskDefinition)
+						fmt.Println("      Last known status:", event.Task.LastStatus)
 					}
 				}
-				PrintTaskDefinition(awsConn, service.TaskDefinition, verboseFlag)
-			}
-			if serviceName == *service.ServiceName {
-				foundService = true
 			}
 		}
+		if service.TaskDefinitionDetails != nil {
+			PrintTaskDefinition(service.TaskDefinitionDetails, verboseFlag)
+		}
 	}
-	// Hmm, we didn't come across the service that was asked for.
-	if (serviceName != "") && (foundService == false) {
-		fmt.Println("  Service", serviceName, "not found.")
+}
+
+//
+// Collects the names of the classic load balancers used by the services, so that GetLoadBalancers can fetch them if
+// desired.
+//
+func (clusterServices *ClusterServices) LoadBalancerNames() []*string {
+	var loadBalancers = make([]*string, 0)
+	for _, service := range clusterServices.Services {
+		for _, balancer := range service.LoadBalancers {
+			if balancer.LoadBalancerName != "" {
+				var name = balancer.LoadBalancerName
+				loadBalancers = append(loadBalancers, &name)
+			}
+		}
 	}
 	return loadBalancers
 }
 
+//
+// Collects the ARNs of the target groups used by the services, so that GetTargetGroups can fetch them if desired.
+//
+func (clusterServices *ClusterServices) TargetGroupArns() []*string {
+	var targetGroups = make([]*string, 0)
+	for _, service := range clusterServices.Services {
+		for _, balancer := range service.LoadBalancers {
+			if balancer.TargetGroupArn != "" {
+				var arn = balancer.TargetGroupArn
+				targetGroups = append(targetGroups, &arn)
+			}
+		}
+	}
+	return targetGroups
+}
+
 //
 // Update a service by specifying a new image URL, which will register a new task definition revision and update the service,
 // meaning the service instances are restarted. If the image URL starts with a colon (:) then it will get the current image URL,
 // and update the service with its current URL using the string as the tag. For example, passing ":latest" will update the
 // service with the same image, tagged 'latest'.
 //
-func UpdateService(creds *credentials.Credentials, region string, clusterName string, serviceName string, newImage string) {
-	if newImage == "" {
-		fmt.Println("Error: You must specify a new image URL to update the image!")
-		os.Exit(1)
+// Each image update is either a bare image URL, which is only allowed when the task has a single container, or takes the
+// form containerName=imageURL to pick the container to change. Several containers can be changed in the same revision.
+//
+// If waitTimeout is non-zero, wait for the new deployment to reach a steady state and return a DeploymentError if it
+// fails or doesn't get there in time. Once it's steady the ELB instance count and target group target counts are
+// compared with the running tasks, like CheckService does, and the deployment fails if they differ or if none of the
+// tasks are healthy in one of the load balancers. Tasks that are merely still unhealthy are only warned about. If
+// rollback is set and the deployment fails, the service is pointed back at the task definition it was using before the
+// update.
+//
+// If dryRun is set, nothing is registered or updated. Instead it prints a plan showing the service that would be
+// changed and a diff between its current task definition and the one that would be registered.
+//
+// Returns the ARN of the task definition that was registered, which is empty for a dry run.
+//
+func UpdateService(clients *Clients, clusterName string, serviceName string,
+	imageUpdates []string, waitTimeout time.Duration, rollback bool, dryRun bool) (string, error) {
+	if len(imageUpdates) == 0 {
+		return "", &ValidationError{Message: "you must specify a new image URL to update the image"}
+	}
+	newImages, err := parseImageUpdates(imageUpdates)
+	if err != nil {
+		return "", err
 	}
-	var updateTag = str.HasPrefix(newImage, ":")
 
-	fmt.Println("Updating service", serviceName)
-	awsConn := GetEcsConnection(creds, region)
+	if dryRun {
+		fmt.Println("Planning update of service", serviceName, "(dry run, nothing will be changed)")
+	} else {
+		fmt.Println("Updating service", serviceName)
+	}
+	awsConn := clients.ECS
 	// Get the service, extract task definition
-	serviceInfo, err := awsConn.DescribeServices(&ecs.DescribeServicesInput{
-		Cluster:  &clusterName,
-		Services: []*string{&serviceName},
-	})
-	CheckError(fmt.Sprintf("fetching service data for service %s", serviceName), err)
-	if len(serviceInfo.Services) == 0 {
-		fmt.Printf("Error: Got zero services for name %s\n", serviceName)
-		os.Exit(1)
+	service, err := describeService(awsConn, clusterName, serviceName)
+	if err != nil {
+		return "", err
 	}
+	// Remember what the service runs now so that we can go back to it.
+	var priorTaskDefinition = *service.TaskDefinition
 	// Get the task definition description
-	taskDefn, err := awsConn.DescribeTaskDefinition(&ecs.DescribeTaskDefinitionInput{TaskDefinition: serviceInfo.Services[0].TaskDefinition})
-	// Right now we only support tasks with a single container.
-	if len(taskDefn.TaskDefinition.ContainerDefinitions) > 1 {
-		fmt.Println("Apologies, this service has multiple containers and I only support one right now.")
-		os.Exit(1)
+	taskDefn, err := awsConn.DescribeTaskDefinition(&ecs.DescribeTaskDefinitionInput{
+		TaskDefinition: &priorTaskDefinition,
+		Include:        []*string{aws.String(ecs.TaskDefinitionFieldTags)},
+	})
+	if err != nil {
+		return "", apiError(fmt.Sprintf("fetching Task Definition for %s", priorTaskDefinition), err)
 	}
-	// Update the image URL
-	if updateTag {
-		var urlParts = str.Split(*taskDefn.TaskDefinition.ContainerDefinitions[0].Image, ":")
-		// If we get more than two parts, we can't safely append the image tag so let's bail out.
-		if len(urlParts) > 2 {
-			fmt.Println("Split on colon found more than two elements in current image URL")
-			os.Exit(1)
+	containers := taskDefn.TaskDefinition.ContainerDefinitions
+
+	// A bare image URL is only unambiguous when there's a single container to apply it to.
+	if image, ok := newImages[""]; ok {
+		if len(containers) > 1 {
+			validationErr := &ValidationError{Message: "this service has multiple containers, use containerName=imageURL to pick one of"}
+			for _, container := range containers {
+				validationErr.Problems = append(validationErr.Problems, *container.Name)
+			}
+			return "", validationErr
+		}
+		if _, named := newImages[*containers[0].Name]; named {
+			return "", &ValidationError{Message: fmt.Sprintf("container %s was given more than one image URL", *containers[0].Name)}
+		}
+		delete(newImages, "")
+		newImages[*containers[0].Name] = image
+	}
+	for name := range newImages {
+		if findContainerDefinition(containers, name) == nil {
+			return "", &NotFoundError{Kind: "container", Name: fmt.Sprintf("%s in task definition %s", name, *taskDefn.TaskDefinition.Family)}
 		}
-		newImage = fmt.Sprintf("%s%s", urlParts[0], newImage) // Since newImage starts with a colon, we can just append
+	}
+
+	// Render the current definition before the images change, so that a plan can show the difference.
+	currentJSON, err := taskDefinitionJSON(registerInputFromTaskDefinition(taskDefn.TaskDefinition, taskDefn.Tags))
+	if err != nil {
+		return "", err
 	}
 
 	fmt.Println("  - Task Definition:", *taskDefn.TaskDefinition.Family)
-	fmt.Println("  - Current image:", *taskDefn.TaskDefinition.ContainerDefinitions[0].Image)
-	fmt.Println("  - Updating to:", newImage)
-	*taskDefn.TaskDefinition.ContainerDefinitions[0].Image = newImage
+	for _, container := range containers {
+		newImage, ok := newImages[*container.Name]
+		if !ok {
+			continue
+		}
+		// Update the image URL
+		if str.HasPrefix(newImage, ":") {
+			if newImage, err = replaceImageTag(*container.Image, newImage); err != nil {
+				return "", err
+			}
+		}
+		fmt.Println("  - Container:", *container.Name)
+		fmt.Println("    Current image:", *container.Image)
+		fmt.Println("    Updating to:", newImage)
+		container.Image = &newImage
+	}
+
+	// Everything but the images is copied from the current revision.
+	registerInput := registerInputFromTaskDefinition(taskDefn.TaskDefinition, taskDefn.Tags)
+	if dryRun {
+		newJSON, err := taskDefinitionJSON(registerInput)
+		if err != nil {
+			return "", err
+		}
+		printUpdatePlan(clusterName, serviceName, priorTaskDefinition, currentJSON, newJSON)
+		return "", nil
+	}
 
 	// Register the task definition
-	taskDefinitionOutput, err := awsConn.RegisterTaskDefinition(&ecs.RegisterTaskDefinitionInput{
-		ContainerDefinitions: taskDefn.TaskDefinition.ContainerDefinitions,
-		Family:               taskDefn.TaskDefinition.Family,
-		Volumes:              taskDefn.TaskDefinition.Volumes,
-                TaskRoleArn:          taskDefn.TaskDefinition.TaskRoleArn,
-                PlacementConstraints: taskDefn.TaskDefinition.PlacementConstraints,
-                NetworkMode:          taskDefn.TaskDefinition.NetworkMode,
-	})
-	CheckError("registering updated task definition", err)
+	taskDefinitionOutput, err := awsConn.RegisterTaskDefinition(registerInput)
+	if err != nil {
+		return "", apiError("registering updated task definition", err)
+	}
+	var newTaskDefinition = *taskDefinitionOutput.TaskDefinition.TaskDefinitionArn
 	fmt.Println("  -> Task definition updated, registered as revision", *taskDefinitionOutput.TaskDefinition.Revision)
 
 	// Update the service
-	updateServiceOutput, err := awsConn.UpdateService(&ecs.UpdateServiceInput{
-		Cluster:        &clusterName,
-		Service:        &serviceName,
-		TaskDefinition: taskDefinitionOutput.TaskDefinition.TaskDefinitionArn,
-	})
-	CheckError("updating service with new task definition", err)
-	fmt.Println("  -> Service updated with new task definition:")
-	fmt.Println("     - Desired count:", *updateServiceOutput.Service.DesiredCount)
-	fmt.Println("     - Pending count:", *updateServiceOutput.Service.PendingCount)
-	fmt.Println("     - Running count:", *updateServiceOutput.Service.RunningCount)
-	fmt.Println("     - Service status:", *updateServiceOutput.Service.Status)
+	var started = time.Now()
+	deploymentId, err := pointServiceAt(awsConn, clusterName, serviceName, newTaskDefinition)
+	if err != nil {
+		return newTaskDefinition, err
+	}
+
+	if waitTimeout > 0 {
+		err = waitForDeployment(awsConn, clusterName, serviceName, deploymentId, started, waitTimeout)
+		if err == nil {
+			var tasks []TaskInfo
+			var taskRunning int
+			var elbFindings, healthFindings []CheckFinding
+			if tasks, _, taskRunning, err = CheckServiceTasks(awsConn, clusterName, serviceName, newTaskDefinition,
+				*service.DesiredCount); err != nil {
+				return newTaskDefinition, err
+			}
+			if elbFindings, healthFindings, err = checkLoadBalancers(clients, clusterName, service, tasks, taskRunning); err != nil {
+				return newTaskDefinition, err
+			}
+			// Instances and targets can still be passing their first health checks, so only a load balancer with
+			// none of the tasks healthy fails the deployment.
+			for _, finding := range healthFindings {
+				if finding.Severity == SeverityCritical {
+					elbFindings = append(elbFindings, finding)
+				} else {
+					fmt.Println("  -> Warning:", finding.Message)
+				}
+			}
+			if len(elbFindings) > 0 {
+				err = &DeploymentError{Reason: elbFindings[0].Message}
+			}
+		}
+		var deploymentErr *DeploymentError
+		if errors.As(err, &deploymentErr) {
+			fmt.Println("  -> Deployment failed:", deploymentErr.Reason)
+			if rollback {
+				fmt.Println("  -> Rolling back to", getRevisionFromTaskDefinition(priorTaskDefinition))
+				if _, rollbackErr := pointServiceAt(awsConn, clusterName, serviceName, priorTaskDefinition); rollbackErr != nil {
+					return newTaskDefinition, rollbackErr
+				}
+				deploymentErr.RolledBackTo = priorTaskDefinition
+			}
+		}
+		if err != nil {
+			return newTaskDefinition, err
+		}
+		fmt.Println("  -> Deployment reached a steady state")
+	}
+	return newTaskDefinition, nil
+}
+
+//
+// Point a service back at an earlier revision of its task definition family without registering anything new. With no
+// revision it picks the newest active revision older than the one the service runs now, otherwise it uses the revision
+// given. If waitTimeout is non-zero, wait for the deployment to settle like UpdateService does. Returns the task
+// definition the service now uses.
+//
+func RollbackService(clients *Clients, clusterName string, serviceName string,
+	revision string, waitTimeout time.Duration) (string, error) {
+	awsConn := clients.ECS
+	service, err := describeService(awsConn, clusterName, serviceName)
+	if err != nil {
+		return "", err
+	}
+	var currentTaskDefinition = *service.TaskDefinition
+	family, currentRevision := splitRevision(getRevisionFromTaskDefinition(currentTaskDefinition))
+
+	var wantedRevision = int64(-1)
+	if revision != "" {
+		// Revisions start at 1, and -1 would be taken for no revision at all.
+		wantedRevision, err = strconv.ParseInt(str.TrimPrefix(revision, family+":"), 10, 64)
+		if err != nil || wantedRevision < 1 {
+			return "", &ValidationError{Message: fmt.Sprintf("revision must be a number from 1 up, got %s", revision)}
+		}
+	}
+
+	// Go through the family's revisions, which are listed oldest first, to find the one we want.
+	taskDefinitionArns, err := listTaskDefinitionArns(awsConn, &ecs.ListTaskDefinitionsInput{FamilyPrefix: &family})
+	if err != nil {
+		return "", err
+	}
+	var target = ""
+	for _, taskdef := range taskDefinitionArns {
+		// The family is only a prefix, so skip any other families that start with the same name.
+		taskFamily, taskRevision := splitRevision(getRevisionFromTaskDefinition(*taskdef))
+		if taskFamily != family {
+			continue
+		}
+		if (wantedRevision == -1 && taskRevision < currentRevision) || taskRevision == wantedRevision {
+			target = *taskdef
+		}
+	}
+	if target == "" {
+		if wantedRevision == -1 {
+			return "", &NotFoundError{Kind: "active revision", Name: fmt.Sprintf("of %s older than %d to roll back to", family, currentRevision)}
+		}
+		return "", &NotFoundError{Kind: "active revision", Name: fmt.Sprintf("%s:%d", family, wantedRevision)}
+	}
+	if target == currentTaskDefinition {
+		fmt.Println("Service", serviceName, "is already using", getRevisionFromTaskDefinition(target))
+		return target, nil
+	}
+
+	fmt.Println("Rolling back service", serviceName)
+	fmt.Println("  - Current task definition:", getRevisionFromTaskDefinition(currentTaskDefinition))
+	fmt.Println("  - Rolling back to:", getRevisionFromTaskDefinition(target))
+	var started = time.Now()
+	deploymentId, err := pointServiceAt(awsConn, clusterName, serviceName, target)
+	if err != nil {
+		return currentTaskDefinition, err
+	}
+
+	if waitTimeout > 0 {
+		if err = waitForDeployment(awsConn, clusterName, serviceName, deploymentId, started, waitTimeout); err != nil {
+			var deploymentErr *DeploymentError
+			if errors.As(err, &deploymentErr) {
+				fmt.Println("  -> Rollback failed:", deploymentErr.Reason)
+			}
+			return target, err
+		}
+		fmt.Println("  -> Deployment reached a steady state")
+	}
+	return target, nil
+}
+
+//
+// ServiceCheck is the result of checking a service: its tasks, how many are running and registered with its load
+// balancers, and findings about anything that looks wrong. Status is the severity of the worst finding, and Summary
+// describes the check on one line for monitoring systems. Stopped lists the tasks that stopped recently by reason, to
+// explain findings such as missing tasks. They aren't findings themselves, since deployments and scaling stop tasks too.
+//
+type ServiceCheck struct {
+	Cluster        string             `json:"cluster"`
+	Service        string             `json:"service"`
+	Status         Severity           `json:"status"`
+	Summary        string             `json:"summary"`
+	TaskDefinition string             `json:"taskDefinition"`
+	DesiredTasks   int64              `json:"desiredTasks"`
+	RunningTasks   int                `json:"runningTasks"`
+	Tasks          []TaskInfo         `json:"tasks"`
+	Findings       []CheckFinding     `json:"findings"`
+	Stopped        []StoppedTaskGroup `json:"stopped"`
 }
 
 //
 // Check the status of a service by fetching the tasks and comparing task definitions and run state
 // to see if tasks are running the same task definition revision that the service is associated with.
+// Each finding is classified as a WARNING or CRITICAL, and a service with none is OK.
 //
-func CheckService(creds *credentials.Credentials, region string, clusterName string, serviceName string, verboseFlag bool) {
-	// get the service task definition
-	awsConn := GetEcsConnection(creds, region)
+func CheckService(clients *Clients, clusterName string, serviceName string) (*ServiceCheck, error) {
 	// Get the service, extract task definition
-	serviceInfo, err := awsConn.DescribeServices(&ecs.DescribeServicesInput{
-		Cluster:  &clusterName,
-		Services: []*string{&serviceName},
-	})
-	CheckError("getting service information", err)
-	if len(serviceInfo.Services) < 1 {
-		fmt.Println("Attempt to fetch service data for", serviceName, "returned no data!")
-		os.Exit(1)
+	serviceDef, err := describeService(clients.ECS, clusterName, serviceName)
+	if err != nil {
+		return nil, err
 	}
-	serviceDef := serviceInfo.Services[0]
+	return checkService(clients, clusterName, serviceDef)
+}
 
-	taskWarnings, taskRunning := CheckServiceTasks(awsConn, clusterName, serviceName, verboseFlag, *serviceDef.TaskDefinition)
-	for _, msg := range taskWarnings {
-		fmt.Println(msg)
+//
+// Print the result of CheckService: the one-line summary, the tasks if verboseFlag is set, then each finding with its
+// severity and the tasks that stopped recently, grouped by reason.
+//
+func PrintServiceCheck(check *ServiceCheck, verboseFlag bool) {
+	fmt.Println(check.Summary)
+	if verboseFlag {
+		printServiceTasks(check.Tasks)
 	}
+	for _, finding := range check.Findings {
+		fmt.Printf("%s: %s\n", finding.Severity, finding.Message)
+	}
+	if len(check.Stopped) > 0 {
+		fmt.Println("Recently stopped tasks:")
+		PrintStoppedTasks(check.Stopped)
+	}
+}
 
-	var elbCount = 0
-	var balancerNames = make([]*string, 0)
-	for _, bals := range serviceDef.LoadBalancers {
-		balancerNames = append(balancerNames, bals.LoadBalancerName)
+/////////////// Private functions
+
+// Check a service that's already been described, the way CheckService does.
+func checkService(clients *Clients, clusterName string, serviceDef *ecs.Service) (*ServiceCheck, error) {
+	var err error
+	check := &ServiceCheck{
+		Cluster:        clusterName,
+		Service:        *serviceDef.ServiceName,
+		TaskDefinition: *serviceDef.TaskDefinition,
+		DesiredTasks:   *serviceDef.DesiredCount,
+	}
+	check.Tasks, check.Findings, check.RunningTasks, err = CheckServiceTasks(clients.ECS, clusterName, check.Service,
+		*serviceDef.TaskDefinition, *serviceDef.DesiredCount)
+	if err != nil {
+		return nil, err
+	}
+	elbFindings, healthFindings, err := checkLoadBalancers(clients, clusterName, serviceDef, check.Tasks, check.RunningTasks)
+	if err != nil {
+		return nil, err
 	}
-	serviceElbs := GetElbData(creds, region, balancerNames)
-	for _, balancer := range serviceElbs.LoadBalancerDescriptions {
-		elbCount += len(balancer.Instances)
+	check.Findings = append(check.Findings, elbFindings...)
+	check.Findings = append(check.Findings, healthFindings...)
+	if check.Stopped, err = getStoppedTaskGroups(clients.ECS, clusterName, check.Service); err != nil {
+		return nil, err
+	}
+	check.Status = worstSeverity(check.Findings)
+	check.Summary = checkSummary(check.Status, clusterName+"/"+check.Service, check.detail(),
+		fmt.Sprintf("running=%d desired=%d", check.RunningTasks, check.DesiredTasks))
+	return check, nil
+}
+
+// Describe the result of a service check in a few words: its most serious findings, or how many tasks are running.
+func (check *ServiceCheck) detail() string {
+	return checkDetail(check.Findings, fmt.Sprintf("%d of %d desired tasks running %s", check.RunningTasks,
+		check.DesiredTasks, getRevisionFromTaskDefinition(check.TaskDefinition)))
+}
+
+//
+// Gather the details of one service: its tasks, up to eventCount recent events with the tasks they mention, and its
+// task definition.
+//
+func getServiceInfo(awsConn ecsiface.ECSAPI, clusterName string, service *ecs.Service, eventCount int) (ServiceInfo, error) {
+	info := ServiceInfo{
+		Name:           *service.ServiceName,
+		Status:         *service.Status,
+		DesiredCount:   *service.DesiredCount,
+		RunningCount:   *service.RunningCount,
+		PendingCount:   *service.PendingCount,
+		TaskDefinition: *service.TaskDefinition,
+		LoadBalancers:  []ServiceLoadBalancer{},
+		Deployments:    []DeploymentInfo{},
+		Events:         []EventInfo{},
+	}
+	for _, balancer := range service.LoadBalancers {
+		info.LoadBalancers = append(info.LoadBalancers, ServiceLoadBalancer{
+			LoadBalancerName: aws.StringValue(balancer.LoadBalancerName),
+			TargetGroupArn:   aws.StringValue(balancer.TargetGroupArn),
+			ContainerName:    aws.StringValue(balancer.ContainerName),
+			ContainerPort:    aws.Int64Value(balancer.ContainerPort),
+		})
+	}
+	for _, depl := range service.Deployments {
+		info.Deployments = append(info.Deployments, DeploymentInfo{
+			Id:             *depl.Id,
+			Status:         *depl.Status,
+			TaskDefinition: *depl.TaskDefinition,
+			DesiredCount:   *depl.DesiredCount,
+			RunningCount:   *depl.RunningCount,
+			PendingCount:   *depl.PendingCount,
+			CreatedAt:      aws.TimeValue(depl.CreatedAt),
+		})
+	}
+	var err error
+	info.Tasks, _, _, err = CheckServiceTasks(awsConn, clusterName, *service.ServiceName, *service.TaskDefinition,
+		*service.DesiredCount)
+	if err != nil {
+		return info, err
+	}
+	if len(service.Events) > 0 { // The most recent event comes first
+		info.LastEventAt = service.Events[0].CreatedAt
+	}
+
+	var eventTaskIds []*string
+	for index := 0; index < eventCount && index < len(service.Events); index++ {
+		event := EventInfo{
+			CreatedAt: *service.Events[index].CreatedAt,
+			Message:   *service.Events[index].Message,
+		}
+		//  Check if the message is about a task. If so, let's get the task ID so we can fetch info about the task
+		var pos = str.Index(event.Message, "(task ")
+		if pos != -1 {
+			event.TaskId = event.Message[pos+6 : len(event.Message)-2]
+			var taskId = event.TaskId
+			eventTaskIds = append(eventTaskIds, &taskId)
+		}
+		info.Events = append(info.Events, event)
 	}
-	if elbCount != taskRunning {
-		fmt.Println("WARNING: ELB instance count of", elbCount, "is different from number of running tasks", taskRunning)
+	// Fetch the tasks the events mention together, rather than with a call per event.
+	eventTasks := map[string]*ecs.Task{}
+	tasks, err := describeTasks(awsConn, clusterName, uniqueStrings(eventTaskIds))
+	if err != nil {
+		return info, err
+	}
+	for _, task := range tasks {
+		eventTasks[(*task.TaskArn)[str.LastIndex(*task.TaskArn, "/")+1:]] = task
+	}
+	for index := range info.Events {
+		if eventTask, found := eventTasks[info.Events[index].TaskId]; found {
+			task := newTaskInfo(eventTask, *service.TaskDefinition)
+			info.Events[index].Task = &task
+		}
+	}
+
+	info.TaskDefinitionDetails, err = GetTaskDefinition(awsConn, *service.TaskDefinition)
+	return info, err
+}
+
+//
+// Turn the image arguments given to update into a map of container name to image URL. A bare image URL with no
+// container name is stored under the empty name, and it's up to the caller to decide which container it means.
+//
+func parseImageUpdates(imageUpdates []string) (map[string]string, error) {
+	newImages := map[string]string{}
+	for _, update := range imageUpdates {
+		var name, image string
+		// Image URLs can't contain an equals sign, so the first one separates the container name.
+		if pos := str.Index(update, "="); pos != -1 {
+			name, image = update[:pos], update[pos+1:]
+			if name == "" {
+				return nil, &ValidationError{Message: fmt.Sprintf("missing container name in %s", update)}
+			}
+		} else {
+			image = update
+		}
+		if image == "" {
+			return nil, &ValidationError{Message: "you must specify a new image URL to update the image"}
+		}
+		// No image URL starts with a dash, but a flag given after the operation's arguments does.
+		if str.HasPrefix(image, "-") {
+			return nil, &ValidationError{Message: fmt.Sprintf("%s isn't an image URL, flags must come before the operation", image)}
+		}
+		if _, dup := newImages[name]; dup {
+			if name == "" {
+				return nil, &ValidationError{Message: "only one image URL can be given without a container name"}
+			}
+			return nil, &ValidationError{Message: fmt.Sprintf("container %s was given more than one image URL", name)}
+		}
+		newImages[name] = image
+	}
+	return newImages, nil
+}
+
+//
+// Given the current image URL and a tag starting with a colon, return the image URL with its tag replaced.
+//
+func replaceImageTag(currentImage string, newTag string) (string, error) {
+	var urlParts = str.Split(currentImage, ":")
+	// If we get more than two parts, we can't safely append the image tag so let's bail out.
+	if len(urlParts) > 2 {
+		return "", &ValidationError{Message: fmt.Sprintf("split on colon found more than two elements in current image URL %s", currentImage)}
+	}
+	return fmt.Sprintf("%s%s", urlParts[0], newTag), nil // Since newTag starts with a colon, we can just append
+}
+
+//
+// Print what an update would do: the task definition it would register, as a diff against the current one, and the
+// service it would point at the new revision.
+//
+func printUpdatePlan(clusterName string, serviceName string, currentTaskDefinition string, currentJSON string, newJSON string) {
+	var currentRevision = getRevisionFromTaskDefinition(currentTaskDefinition)
+	family, _ := splitRevision(currentRevision)
+	fmt.Println("Plan:")
+	fmt.Println("  - Register a new revision of task definition family", family)
+	fmt.Println("  - Update service", serviceName, "in cluster", clusterName, "from", currentRevision, "to the new revision")
+	fmt.Println("  - Task definition changes:")
+	diff := diffLines(str.Split(currentJSON, "\n"), str.Split(newJSON, "\n"), 3)
+	if len(diff) == 0 {
+		fmt.Println("    (none, the new revision would be identical)")
+		return
+	}
+	fmt.Println("    ---", currentRevision)
+	fmt.Println("    +++", family+":<new revision>")
+	for _, line := range diff {
+		fmt.Println("   ", line)
+	}
+}
+
+//
+// Point the service at the given task definition, which starts a new deployment, and print the resulting counts.
+// Returns the ID of the new deployment, which is the service's PRIMARY one, so that it can be followed.
+//
+func pointServiceAt(awsConn ecsiface.ECSAPI, clusterName string, serviceName string, taskDefinitionArn string) (string, error) {
+	updateServiceOutput, err := awsConn.UpdateService(&ecs.UpdateServiceInput{
+		Cluster:        &clusterName,
+		Service:        &serviceName,
+		TaskDefinition: &taskDefinitionArn,
+	})
+	if err != nil {
+		return "", apiError(fmt.Sprintf("updating service to task definition %s", getRevisionFromTaskDefinition(taskDefinitionArn)), err)
+	}
+	var deploymentId string
+	for _, depl := range updateServiceOutput.Service.Deployments {
+		if aws.StringValue(depl.Status) == "PRIMARY" {
+			deploymentId = aws.StringValue(depl.Id)
+		}
+	}
+	fmt.Println("  -> Service updated to task definition", getRevisionFromTaskDefinition(taskDefinitionArn))
+	fmt.Println("     - Desired count:", *updateServiceOutput.Service.DesiredCount)
+	fmt.Println("     - Pending count:", *updateServiceOutput.Service.PendingCount)
+	fmt.Println("     - Running count:", *updateServiceOutput.Service.RunningCount)
+	fmt.Println("     - Service status:", *updateServiceOutput.Service.Status)
+	return deploymentId, nil
+}
+
+// Fetch one service, returning a NotFoundError if the cluster has no service by that name.
+func describeService(awsConn ecsiface.ECSAPI, clusterName string, serviceName string) (*ecs.Service, error) {
+	services, err := describeServices(awsConn, clusterName, []*string{&serviceName})
+	if err != nil {
+		return nil, err
+	}
+	if len(services) == 0 {
+		return nil, &NotFoundError{Kind: "service", Name: fmt.Sprintf("%s in cluster %s", serviceName, clusterName)}
+	}
+	return services[0], nil
+}
+
+// Find a container definition by name, or nil if there's no such container.
+func findContainerDefinition(containers []*ecs.ContainerDefinition, name string) *ecs.ContainerDefinition {
+	for _, container := range containers {
+		if *container.Name == name {
+			return container
+		}
 	}
+	return nil
 }
@@ -0,0 +1,281 @@
+package components
+
+import str "strings"
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+func TestUpdateServiceReplacesTag(t *testing.T) {
+	fake := newFakeECS()
+	current := fake.addTaskDefinition("api", fakeContainer("api", "acme/api:v1"))
+	fake.tags[current] = []*ecs.Tag{{Key: aws.String("team"), Value: aws.String("payments")}}
+	fake.addService("api", current, 2)
+
+	newArn, err := UpdateService(fake.clients(), "prod", "api", []string{":v2"}, 0, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.registered) != 1 {
+		t.Fatalf("registered %d task definitions, want 1", len(fake.registered))
+	}
+	registered := fake.registered[0]
+	if image := *registered.ContainerDefinitions[0].Image; image != "acme/api:v2" {
+		t.Errorf("registered image %s, want acme/api:v2", image)
+	}
+	if len(registered.Tags) != 1 || *registered.Tags[0].Key != "team" {
+		t.Errorf("tags weren't carried over to the new revision: %v", registered.Tags)
+	}
+	if getRevisionFromTaskDefinition(newArn) != "api:2" {
+		t.Errorf("returned %s, want revision api:2", newArn)
+	}
+	if len(fake.updated) != 1 || *fake.updated[0].TaskDefinition != newArn {
+		t.Errorf("service wasn't pointed at %s: %v", newArn, fake.updated)
+	}
+	if image := *fake.findTaskDefinition(current).ContainerDefinitions[0].Image; image != "acme/api:v1" {
+		t.Errorf("current revision was changed to %s", image)
+	}
+}
+
+func TestUpdateServiceNamedContainers(t *testing.T) {
+	fake := newFakeECS()
+	current := fake.addTaskDefinition("web",
+		fakeContainer("app", "acme/web"),
+		fakeContainer("proxy", "nginx:1.19"),
+		fakeContainer("logs", "fluentd:v1"))
+	fake.addService("web", current, 1)
+
+	_, err := UpdateService(fake.clients(), "prod", "web", []string{"app=:build-7", "logs=fluent/fluent-bit:2"}, 0, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"acme/web:build-7", "nginx:1.19", "fluent/fluent-bit:2"}
+	for index, container := range fake.registered[0].ContainerDefinitions {
+		if *container.Image != want[index] {
+			t.Errorf("container %s has image %s, want %s", *container.Name, *container.Image, want[index])
+		}
+	}
+}
+
+func TestUpdateServiceRejects(t *testing.T) {
+	fake := newFakeECS()
+	fake.addService("single", fake.addTaskDefinition("single", fakeContainer("app", "acme/app:v1")), 1)
+	fake.addService("multi", fake.addTaskDefinition("multi",
+		fakeContainer("app", "acme/app:v1"), fakeContainer("proxy", "nginx")), 1)
+	fake.addService("port", fake.addTaskDefinition("port", fakeContainer("app", "registry:5000/app:v1")), 1)
+
+	var validation *ValidationError
+	var notFound *NotFoundError
+	tests := []struct {
+		service string
+		images  []string
+		target  interface{}
+	}{
+		{"single", nil, &validation},
+		{"single", []string{"=:v2"}, &validation},
+		{"single", []string{":v2", ":v3"}, &validation},
+		{"single", []string{"app=:v2", ":v3"}, &validation},
+		{"single", []string{"app=:v2", "-dry-run"}, &validation},
+		{"single", []string{"-dry-run"}, &validation},
+		{"multi", []string{":v2"}, &validation},
+		{"multi", []string{"sidecar=:v2"}, &notFound},
+		{"port", []string{":v2"}, &validation},
+		{"missing", []string{":v2"}, &notFound},
+	}
+	for _, test := range tests {
+		_, err := UpdateService(fake.clients(), "prod", test.service, test.images, 0, false, false)
+		if !errors.As(err, test.target) {
+			t.Errorf("updating %s with %v returned %v, want a %T", test.service, test.images, err, test.target)
+		}
+	}
+	if len(fake.registered) != 0 || len(fake.updated) != 0 {
+		t.Errorf("rejected updates registered %d task definitions and updated %d services", len(fake.registered), len(fake.updated))
+	}
+}
+
+func TestUpdateServiceDryRun(t *testing.T) {
+	fake := newFakeECS()
+	fake.addService("api", fake.addTaskDefinition("api", fakeContainer("api", "acme/api:v1")), 1)
+
+	newArn, err := UpdateService(fake.clients(), "prod", "api", []string{":v2"}, 0, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newArn != "" || len(fake.registered) != 0 || len(fake.updated) != 0 {
+		t.Errorf("dry run returned %q, registered %d task definitions and updated %d services",
+			newArn, len(fake.registered), len(fake.updated))
+	}
+}
+
+func TestUpdateServiceWaitsForHealth(t *testing.T) {
+	fake := newFakeECS()
+	current := fake.addTaskDefinition("api", fakeContainer("api", "acme/api:v1"))
+	tests := []struct {
+		service    string
+		targets    []string
+		rolledBack bool
+	}{
+		{"settling", []string{"healthy", "unhealthy"}, false}, // One target still failing its first health checks
+		{"failing", []string{"unhealthy", "unhealthy"}, true},
+	}
+	for _, test := range tests {
+		fake.addService(test.service, current, 2)
+		fake.services[test.service].LoadBalancers = []*ecs.LoadBalancer{{
+			TargetGroupArn: aws.String(fake.elbv2.addTargetGroup(test.service, test.targets...)),
+			ContainerName:  aws.String("api"),
+			ContainerPort:  aws.Int64(8080),
+		}}
+		fake.addTaskWithIP(test.service, current, "10.0.1.1")
+		fake.addTaskWithIP(test.service, current, "10.0.1.2")
+		fake.updated = nil
+
+		_, err := UpdateService(fake.clients(), "prod", test.service, []string{":v2"}, time.Minute, true, false)
+		var deploymentErr *DeploymentError
+		if failed := errors.As(err, &deploymentErr); failed != test.rolledBack || (!failed && err != nil) {
+			t.Errorf("%s: update returned %v", test.service, err)
+		}
+		if rolledBack := len(fake.updated) == 2 && *fake.updated[1].TaskDefinition == current; rolledBack != test.rolledBack {
+			t.Errorf("%s: rolled back is %v, want %v", test.service, rolledBack, test.rolledBack)
+		}
+	}
+}
+
+func TestRollbackService(t *testing.T) {
+	fake := newFakeECS()
+	previous := fake.addTaskDefinition("api", fakeContainer("api", "acme/api:v1"))
+	fake.addService("api", fake.addTaskDefinition("api", fakeContainer("api", "acme/api:v2")), 1)
+
+	var validation *ValidationError
+	for _, revision := range []string{"-1", "api:-1", "0", "latest"} {
+		if _, err := RollbackService(fake.clients(), "prod", "api", revision, 0); !errors.As(err, &validation) {
+			t.Errorf("rolling back to %q returned %v, want a ValidationError", revision, err)
+		}
+	}
+	if len(fake.updated) != 0 {
+		t.Fatalf("rejected rollbacks updated the service %d times", len(fake.updated))
+	}
+
+	target, err := RollbackService(fake.clients(), "prod", "api", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != previous || *fake.services["api"].TaskDefinition != previous {
+		t.Errorf("rolled back to %s, want the previous revision %s", target, previous)
+	}
+}
+
+func TestCheckService(t *testing.T) {
+	fake := newFakeECS()
+	old := fake.addTaskDefinition("api", fakeContainer("api", "acme/api:v1"))
+	current := fake.addTaskDefinition("api", fakeContainer("api", "acme/api:v2"))
+	fake.addService("healthy", current, 1)
+	fake.addTask("healthy", current, "RUNNING")
+	fake.addService("mixed", current, 2)
+	fake.addTask("mixed", old, "RUNNING")
+	fake.addTask("mixed", old, "RUNNING")
+	fake.addService("down", current, 2)
+
+	tests := []struct {
+		service string
+		status  Severity
+		summary string
+	}{
+		{"healthy", SeverityOK, "ECS OK - prod/healthy: 1 of 1 desired tasks running api:2 | running=1 desired=1"},
+		{"mixed", SeverityWarning, "ECS WARNING - prod/mixed: task uses api:1 but service definition is api:2 | running=2 desired=2"},
+		{"down", SeverityCritical, "ECS CRITICAL - prod/down: No tasks in RUNNING state for the service, 2 desired | running=0 desired=2"},
+	}
+	for _, test := range tests {
+		check, err := CheckService(fake.clients(), "prod", test.service)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if check.Status != test.status || check.Summary != test.summary {
+			t.Errorf("%s: got %s with summary %q, want %s with %q", test.service, check.Status, check.Summary, test.status, test.summary)
+		}
+	}
+}
+
+func TestCheckClusters(t *testing.T) {
+	fake := newFakeECS()
+	old := fake.addTaskDefinition("api", fakeContainer("api", "acme/api:v1"))
+	current := fake.addTaskDefinition("api", fakeContainer("api", "acme/api:v2"))
+	fake.addService("api", current, 1)
+	fake.addTask("api", current, "RUNNING")
+	fake.addService("search", current, 2)
+	fake.addTask("search", current, "RUNNING")
+	fake.cluster = "staging"
+	fake.addService("billing", current, 1)
+	fake.addService("mailer", current, 1)
+	fake.addTask("mailer", old, "RUNNING")
+	fake.addService("worker", current, 0)
+
+	report, err := CheckClusters(fake.clients(), []string{"prod"}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Status != SeverityWarning || report.Healthy != 1 || report.Degraded != 1 || report.Down != 0 {
+		t.Errorf("prod: got %s with %d healthy, %d degraded, %d down", report.Status, report.Healthy, report.Degraded, report.Down)
+	}
+
+	report, err = CheckClusters(fake.clients(), nil, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want = "ECS CRITICAL - all clusters: 2 healthy, 2 degraded, 1 down; down: staging/billing; " +
+		"degraded: prod/search, staging/mailer | healthy=2 degraded=2 down=1"
+	if report.Status != SeverityCritical || report.Summary != want {
+		t.Errorf("got %s with summary %q, want CRITICAL with %q", report.Status, report.Summary, want)
+	}
+	var checked []string
+	for _, check := range report.Services {
+		checked = append(checked, check.Cluster+"/"+check.Service)
+	}
+	if str.Join(checked, " ") != "prod/api prod/search staging/billing staging/mailer staging/worker" {
+		t.Errorf("services checked in the order %v", checked)
+	}
+
+	var notFound *NotFoundError
+	if _, err := CheckClusters(fake.clients(), []string{"missing"}, 1); !errors.As(err, &notFound) {
+		t.Errorf("checking a missing cluster returned %v, want a NotFoundError", err)
+	}
+}
+
+func TestCheckServiceTargetGroups(t *testing.T) {
+	fake := newFakeECS()
+	current := fake.addTaskDefinition("api", fakeContainer("api", "acme/api:v2"))
+	tests := []struct {
+		service string
+		running int
+		targets []string
+		status  Severity
+		detail  string
+	}{
+		{"matched", 2, []string{"healthy", "initial", "draining"}, SeverityOK, "2 of 2 desired tasks running api:1"},
+		{"extra", 1, []string{"healthy", "healthy"}, SeverityWarning,
+			"only 1 of 2 desired tasks running; target group extra has 2 targets registered but 1 tasks running"},
+		{"empty", 2, []string{"draining"}, SeverityCritical, "no targets registered with target group empty for 2 running tasks"},
+	}
+	for _, test := range tests {
+		fake.addService(test.service, current, 2)
+		fake.services[test.service].LoadBalancers = []*ecs.LoadBalancer{{
+			TargetGroupArn: aws.String(fake.elbv2.addTargetGroup(test.service, test.targets...)),
+			ContainerName:  aws.String("api"),
+			ContainerPort:  aws.Int64(8080),
+		}}
+		for count := 0; count < test.running; count++ {
+			fake.addTask(test.service, current, "RUNNING")
+		}
+
+		check, err := CheckService(fake.clients(), "prod", test.service)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if check.Status != test.status || check.detail() != test.detail {
+			t.Errorf("%s: got %s with %q, want %s with %q", test.service, check.Status, check.detail(), test.status, test.detail)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+/*
+Functions that explain why the tasks of an ECS service stopped.
+
+Womply, www.womply.com
+*/
+package components
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+)
+
+//
+// StoppedTaskGroup is a reason ECS gave for stopping tasks, such as "Essential container in task exited", and the
+// recently stopped tasks of a service that stopped for it, the most recently stopped first.
+//
+type StoppedTaskGroup struct {
+	Reason string        `json:"reason"`
+	Tasks  []StoppedTask `json:"tasks"`
+}
+
+//
+// StoppedTask describes a stopped task and its containers. StopCode is ECS's short code for why it stopped, such as
+// EssentialContainerExited or TaskFailedToStart. The times are missing if the task never got that far.
+//
+type StoppedTask struct {
+	Arn            string             `json:"arn"`
+	TaskDefinition string             `json:"taskDefinition"`
+	StopCode       string             `json:"stopCode,omitempty"`
+	StoppedReason  string             `json:"stoppedReason"`
+	CreatedAt      *time.Time         `json:"createdAt,omitempty"`
+	StartedAt      *time.Time         `json:"startedAt,omitempty"`
+	StoppedAt      *time.Time         `json:"stoppedAt,omitempty"`
+	Containers     []StoppedContainer `json:"containers"`
+}
+
+//
+// StoppedContainer is a container of a stopped task, with its exit code if it ran and exited, and the reason ECS gave
+// if it was stopped for something like running out of memory or an image that couldn't be pulled.
+//
+type StoppedContainer struct {
+	Name     string `json:"name"`
+	ExitCode *int64 `json:"exitCode,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// What a stopped task is grouped under when ECS didn't say why it stopped.
+const noStoppedReason = "no reason given"
+
+//
+// Fetch the tasks of a service that have stopped recently, which ECS keeps for about an hour, and group them by the
+// reason they stopped. The group with the most recently stopped task comes first.
+//
+func GetStoppedTasks(clients *Clients, clusterName string, serviceName string) ([]StoppedTaskGroup, error) {
+	// Make sure the service exists, since ECS lists no tasks for one that doesn't.
+	if _, err := describeService(clients.ECS, clusterName, serviceName); err != nil {
+		return nil, err
+	}
+	return getStoppedTaskGroups(clients.ECS, clusterName, serviceName)
+}
+
+//
+// Prints the stopped tasks fetched by GetStoppedTasks, one group per reason with how many tasks stopped for it, then
+// when each task stopped and the exit code or reason of each of its containers.
+//
+func PrintStoppedTasks(groups []StoppedTaskGroup) {
+	if len(groups) == 0 {
+		fmt.Println("  No recently stopped tasks")
+		return
+	}
+	for _, group := range groups {
+		fmt.Printf("  - %d task(s) stopped: %s\n", len(group.Tasks), group.Reason)
+		for _, task := range group.Tasks {
+			fmt.Printf("    - Task %s (%s)\n", task.Arn, getRevisionFromTaskDefinition(task.TaskDefinition))
+			if task.StoppedAt != nil {
+				fmt.Printf("      Stopped at %s, %s ago", task.StoppedAt, formatAge(time.Since(*task.StoppedAt)))
+				if task.StartedAt != nil {
+					fmt.Printf(", after running for %s", task.StoppedAt.Sub(*task.StartedAt).Truncate(time.Second))
+				}
+				fmt.Println("")
+			}
+			if task.StopCode != "" {
+				fmt.Println("      Stop code:", task.StopCode)
+			}
+			for _, container := range task.Containers {
+				fmt.Println("      -", container.description())
+			}
+		}
+	}
+}
+
+/////////////// Private functions
+
+// Fetch the stopped tasks of a service, describe them and group them by the reason they stopped.
+func getStoppedTaskGroups(awsConn ecsiface.ECSAPI, clusterName string, serviceName string) ([]StoppedTaskGroup, error) {
+	tasks, err := getStoppedServiceTasks(awsConn, clusterName, serviceName)
+	if err != nil {
+		return nil, err
+	}
+	var stopped = make([]StoppedTask, 0, len(tasks))
+	for _, task := range tasks {
+		stopped = append(stopped, newStoppedTask(task))
+	}
+	// Most recently stopped first. Tasks still stopping have no StoppedAt yet, and go first as the most recent.
+	sort.SliceStable(stopped, func(i, j int) bool {
+		if stopped[i].StoppedAt == nil || stopped[j].StoppedAt == nil {
+			return stopped[i].StoppedAt == nil && stopped[j].StoppedAt != nil
+		}
+		return stopped[i].StoppedAt.After(*stopped[j].StoppedAt)
+	})
+
+	var groups = make([]StoppedTaskGroup, 0)
+	var groupIndex = map[string]int{}
+	for _, task := range stopped {
+		var reason = task.StoppedReason
+		if reason == "" {
+			reason = noStoppedReason
+		}
+		index, found := groupIndex[reason]
+		if !found {
+			index = len(groups)
+			groupIndex[reason] = index
+			groups = append(groups, StoppedTaskGroup{Reason: reason})
+		}
+		groups[index].Tasks = append(groups[index].Tasks, task)
+	}
+	return groups, nil
+}
+
+// Fetch the tasks of a service that ECS still lists as stopped.
+func getStoppedServiceTasks(awsConn ecsiface.ECSAPI, clusterName string, serviceName string) ([]*ecs.Task, error) {
+	var stopped = ecs.DesiredStatusStopped
+	taskArns, err := listTaskArns(awsConn, &ecs.ListTasksInput{
+		Cluster:       &clusterName,
+		ServiceName:   &serviceName,
+		DesiredStatus: &stopped,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return describeTasks(awsConn, clusterName, taskArns)
+}
+
+// Describe a stopped task and its containers.
+func newStoppedTask(task *ecs.Task) StoppedTask {
+	info := StoppedTask{
+		Arn:            aws.StringValue(task.TaskArn),
+		TaskDefinition: aws.StringValue(task.TaskDefinitionArn),
+		StopCode:       aws.StringValue(task.StopCode),
+		StoppedReason:  aws.StringValue(task.StoppedReason),
+		CreatedAt:      task.CreatedAt,
+		StartedAt:      task.StartedAt,
+		StoppedAt:      task.StoppedAt,
+		Containers:     []StoppedContainer{},
+	}
+	for _, container := range task.Containers {
+		info.Containers = append(info.Containers, StoppedContainer{
+			Name:     aws.StringValue(container.Name),
+			ExitCode: container.ExitCode,
+			Reason:   aws.StringValue(container.Reason),
+		})
+	}
+	return info
+}
+
+// Describe how a container stopped, e.g. "container api exited with code 137: OutOfMemoryError: Container killed due
+// to memory usage".
+func (container StoppedContainer) description() string {
+	var description = "container " + container.Name
+	switch {
+	case container.ExitCode != nil:
+		description += fmt.Sprintf(" exited with code %d", *container.ExitCode)
+	case container.Reason == "":
+		description += " has no exit code"
+	}
+	if container.Reason != "" {
+		description += ": " + container.Reason
+	}
+	return description
+}
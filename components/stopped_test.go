@@ -0,0 +1,82 @@
+package components
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+func TestGetStoppedTasks(t *testing.T) {
+	fake := newFakeECS()
+	current := fake.addTaskDefinition("api", fakeContainer("api", "acme/api:v2"))
+	fake.addService("api", current, 2)
+	fake.addTask("api", current, "RUNNING")
+	exited := "Essential container in task exited"
+	fake.addStoppedTask("api", current, 20*time.Minute, exited,
+		&ecs.Container{Name: aws.String("api"), ExitCode: aws.Int64(1)})
+	fake.addStoppedTask("api", current, 5*time.Minute, "Task failed ELB health checks")
+	fake.addStoppedTask("api", current, 2*time.Minute, exited,
+		&ecs.Container{Name: aws.String("api"), ExitCode: aws.Int64(137), Reason: aws.String("OutOfMemoryError")})
+	fake.addStoppedTask("api", current, 30*time.Minute, "")
+	fake.addService("web", current, 1)
+	fake.addStoppedTask("web", current, time.Minute, exited)
+
+	groups, err := GetStoppedTasks(fake.clients(), "prod", "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		reason string
+		tasks  []string
+	}{
+		{exited, []string{fakeArnPrefix + "task/4", fakeArnPrefix + "task/2"}},
+		{"Task failed ELB health checks", []string{fakeArnPrefix + "task/3"}},
+		{noStoppedReason, []string{fakeArnPrefix + "task/5"}},
+	}
+	if len(groups) != len(want) {
+		t.Fatalf("got %d groups, want %d: %v", len(groups), len(want), groups)
+	}
+	for index, group := range groups {
+		if group.Reason != want[index].reason || len(group.Tasks) != len(want[index].tasks) {
+			t.Errorf("group %d is %q with %d tasks, want %q with %d", index, group.Reason, len(group.Tasks),
+				want[index].reason, len(want[index].tasks))
+			continue
+		}
+		for taskIndex, task := range group.Tasks {
+			if task.Arn != want[index].tasks[taskIndex] {
+				t.Errorf("%q task %d is %s, want %s", group.Reason, taskIndex, task.Arn, want[index].tasks[taskIndex])
+			}
+		}
+	}
+	if description := groups[0].Tasks[0].Containers[0].description(); description !=
+		"container api exited with code 137: OutOfMemoryError" {
+		t.Errorf("container described as %q", description)
+	}
+
+	var notFound *NotFoundError
+	if _, err := GetStoppedTasks(fake.clients(), "prod", "missing"); !errors.As(err, &notFound) {
+		t.Errorf("listing the stopped tasks of a missing service returned %v, want a NotFoundError", err)
+	}
+}
+
+func TestCheckServiceStoppedTasks(t *testing.T) {
+	fake := newFakeECS()
+	current := fake.addTaskDefinition("api", fakeContainer("api", "acme/api:v2"))
+	fake.addService("api", current, 1)
+	fake.addTask("api", current, "RUNNING")
+	fake.addStoppedTask("api", current, 10*time.Minute, "Scaling activity initiated by (deployment ecs-svc/1)")
+
+	check, err := CheckService(fake.clients(), "prod", "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if check.Status != SeverityOK {
+		t.Errorf("a stopped task made the check %s, want OK", check.Status)
+	}
+	if len(check.Stopped) != 1 || len(check.Stopped[0].Tasks) != 1 {
+		t.Errorf("check found stopped tasks %v, want the one stopped task", check.Stopped)
+	}
+}
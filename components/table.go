@@ -0,0 +1,214 @@
+/*
+Functions that print cluster and service listings as aligned tables, one row per cluster or service.
+
+Womply, www.womply.com
+*/
+package components
+
+import str "strings"
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// The columns of the table printed by PrintClusterTable. -sort takes their names in lower case, with spaces as dashes.
+var clusterColumns = []string{"NAME", "STATUS", "SERVICES", "INSTANCES", "RUNNING", "PENDING"}
+
+// The columns of the table printed by PrintServiceTable.
+var serviceColumns = []string{"NAME", "STATUS", "DESIRED", "RUNNING", "PENDING", "REVISION", "IMAGE", "DEPLOYMENTS", "LAST EVENT"}
+
+//
+// Print one row per cluster with the counts that PrintClusters shows, sorted by the column named in sortBy.
+//
+func PrintClusterTable(clusters []ClusterInfo, sortBy string) error {
+	var rows = make([][]interface{}, 0, len(clusters))
+	for _, cluster := range clusters {
+		rows = append(rows, []interface{}{
+			cluster.Name,
+			cluster.Status,
+			cluster.ActiveServices,
+			cluster.ContainerInstances,
+			cluster.RunningTasks,
+			cluster.PendingTasks,
+		})
+	}
+	return printTable(clusterColumns, rows, sortBy)
+}
+
+//
+// Print one row per service fetched by GetServices, sorted by the column named in sortBy. The revision is the task
+// definition's family:revision, the image is the tag of each container's image, and the last event is how long ago
+// the service's most recent event happened.
+//
+func PrintServiceTable(clusterServices *ClusterServices, sortBy string) error {
+	var rows = make([][]interface{}, 0, len(clusterServices.Services))
+	for _, service := range clusterServices.Services {
+		family, number := splitRevision(getRevisionFromTaskDefinition(service.TaskDefinition))
+		var lastEvent = time.Duration(-1) // No events
+		if service.LastEventAt != nil {
+			lastEvent = time.Since(*service.LastEventAt)
+		}
+		rows = append(rows, []interface{}{
+			service.Name,
+			service.Status,
+			service.DesiredCount,
+			service.RunningCount,
+			service.PendingCount,
+			tableRevision{family, number},
+			serviceImageTags(service.TaskDefinitionDetails),
+			int64(len(service.Deployments)),
+			lastEvent,
+		})
+	}
+	return printTable(serviceColumns, rows, sortBy)
+}
+
+/////////////// Private functions
+
+// A task definition revision in a table, kept as its parts so that revision 10 sorts after revision 9.
+type tableRevision struct {
+	family string
+	number int64
+}
+
+//
+// Sort the rows by the named column and print them under the column headings, lined up with a tabwriter. The column
+// name is matched without regard to case, and a leading "-" reverses the order. Rows that are equal in the sort column
+// keep the order they were given in, which is by name for the listings. Nothing is printed if the column is unknown.
+//
+func printTable(columns []string, rows [][]interface{}, sortBy string) error {
+	var descending = str.HasPrefix(sortBy, "-")
+	sortBy = str.ToLower(str.TrimPrefix(sortBy, "-"))
+	var sortColumn = -1
+	var names []string
+	for index, column := range columns {
+		names = append(names, str.Replace(str.ToLower(column), " ", "-", -1)) // So "LAST EVENT" is "last-event"
+		if names[index] == sortBy {
+			sortColumn = index
+		}
+	}
+	if sortColumn == -1 {
+		return &ValidationError{Message: fmt.Sprintf("can't sort by %q, use one of: %s", sortBy, str.Join(names, ", "))}
+	}
+	sort.SliceStable(rows, func(a, b int) bool {
+		first, second := rows[a][sortColumn], rows[b][sortColumn]
+		if tableCellMissing(first) || tableCellMissing(second) { // Rows without a value go last either way
+			return tableCellMissing(second) && !tableCellMissing(first)
+		}
+		if descending {
+			return tableCellLess(second, first)
+		}
+		return tableCellLess(first, second)
+	})
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, str.Join(columns, "\t"))
+	for _, row := range rows {
+		var cells = make([]string, len(row))
+		for index, cell := range row {
+			cells[index] = tableCellText(cell)
+		}
+		fmt.Fprintln(writer, str.Join(cells, "\t"))
+	}
+	return writer.Flush()
+}
+
+// Whether a cell has no value, such as the last event of a service without events.
+func tableCellMissing(cell interface{}) bool {
+	age, isAge := cell.(time.Duration)
+	return isAge && age < 0
+}
+
+// Compare two cells of the same column. Ages sort with the most recent first.
+func tableCellLess(a interface{}, b interface{}) bool {
+	switch typed := a.(type) {
+	case int64:
+		return typed < b.(int64)
+	case time.Duration:
+		return typed < b.(time.Duration)
+	case tableRevision:
+		other := b.(tableRevision)
+		if typed.family != other.family {
+			return typed.family < other.family
+		}
+		return typed.number < other.number
+	}
+	return fmt.Sprint(a) < fmt.Sprint(b)
+}
+
+// Format a table cell for printing.
+func tableCellText(cell interface{}) string {
+	switch typed := cell.(type) {
+	case int64:
+		return strconv.FormatInt(typed, 10)
+	case time.Duration:
+		return formatAge(typed)
+	case tableRevision:
+		if typed.number < 0 {
+			return typed.family
+		}
+		return fmt.Sprintf("%s:%d", typed.family, typed.number)
+	case string:
+		if typed == "" {
+			return "-"
+		}
+		return typed
+	}
+	return fmt.Sprint(cell)
+}
+
+// Format how long ago something happened in its largest whole unit, such as "45s", "12m", "5h" or "3d".
+func formatAge(age time.Duration) string {
+	switch {
+	case age < 0:
+		return "-"
+	case age < time.Minute:
+		return fmt.Sprintf("%ds", int64(age/time.Second))
+	case age < time.Hour:
+		return fmt.Sprintf("%dm", int64(age/time.Minute))
+	case age < 48*time.Hour:
+		return fmt.Sprintf("%dh", int64(age/time.Hour))
+	}
+	return fmt.Sprintf("%dd", int64(age/(24*time.Hour)))
+}
+
+//
+// The distinct image tags of a task definition's containers, in container order and separated by commas. An image
+// without a tag is shown as "latest", which is what Docker pulls for it, and one pinned by digest shows the start of
+// the digest.
+//
+func serviceImageTags(taskDefinition *TaskDefinitionInfo) string {
+	if taskDefinition == nil {
+		return ""
+	}
+	var tags []string
+	var seen = map[string]bool{}
+	for _, container := range taskDefinition.Containers {
+		var tag = imageTag(container.Image)
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	return str.Join(tags, ",")
+}
+
+// Get the tag or digest from an image reference such as registry:5000/repo/name:tag.
+func imageTag(image string) string {
+	if pos := str.Index(image, "@"); pos != -1 {
+		var digest = image[pos+1:]
+		if len(digest) > 19 { // "sha256:" and the first 12 hex digits, like docker images prints
+			digest = digest[:19]
+		}
+		return digest
+	}
+	var name = image[str.LastIndex(image, "/")+1:] // The registry can have a port, so only look after the last slash
+	if pos := str.LastIndex(name, ":"); pos != -1 {
+		return name[pos+1:]
+	}
+	return "latest"
+}
@@ -0,0 +1,172 @@
+/*
+Functions dealing with the target groups of application and network load balancers used by ECS services.
+
+Womply, www.womply.com
+*/
+package components
+
+import str "strings"
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+)
+
+//
+// TargetGroupInfo describes a target group, the load balancers that send traffic to it, and the targets registered
+// with it. A target is an instance for the instance target type, or a task's IP address for awsvpc tasks.
+//
+type TargetGroupInfo struct {
+	Name          string           `json:"name"`
+	Arn           string           `json:"arn"`
+	Protocol      string           `json:"protocol"`
+	Port          int64            `json:"port"`
+	TargetType    string           `json:"targetType"`
+	LoadBalancers []LoadBalancerV2 `json:"loadBalancers"`
+	Targets       []TargetInfo     `json:"targets"`
+}
+
+// LoadBalancerV2 describes an application or network load balancer.
+type LoadBalancerV2 struct {
+	Name    string `json:"name"`
+	Arn     string `json:"arn"`
+	Type    string `json:"type"` // application or network
+	Scheme  string `json:"scheme"`
+	DNSName string `json:"dnsName"`
+	State   string `json:"state"`
+}
+
+//
+// TargetInfo is a target registered with a target group and its health. State is one of the states ELB reports, such
+// as healthy, unhealthy, initial or draining, and Reason and Description say why when it isn't healthy.
+//
+type TargetInfo struct {
+	Id          string `json:"id"`
+	Port        int64  `json:"port"`
+	State       string `json:"state"`
+	Reason      string `json:"reason,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+//
+// Takes a list of target group ARNs and retrieves their details, their load balancers and the health of their targets.
+//
+func GetTargetGroups(clients *Clients, targetGroupArns []*string) ([]TargetGroupInfo, error) {
+	var groups = make([]TargetGroupInfo, 0)
+	targetGroupArns = uniqueStrings(targetGroupArns)
+	if len(targetGroupArns) == 0 {
+		return groups, nil
+	}
+	targetGroups, err := describeTargetGroups(clients.ELBV2, targetGroupArns)
+	if err != nil {
+		return nil, err
+	}
+
+	// Several target groups can share a load balancer, so describe each load balancer once.
+	var balancerArns []*string
+	for _, group := range targetGroups {
+		balancerArns = append(balancerArns, group.LoadBalancerArns...)
+	}
+	balancers, err := describeLoadBalancersV2(clients.ELBV2, uniqueStrings(balancerArns))
+	if err != nil {
+		return nil, err
+	}
+	var balancersByArn = map[string]*elbv2.LoadBalancer{}
+	for _, balancer := range balancers {
+		balancersByArn[*balancer.LoadBalancerArn] = balancer
+	}
+
+	for _, group := range targetGroups {
+		info := TargetGroupInfo{
+			Name:          aws.StringValue(group.TargetGroupName),
+			Arn:           aws.StringValue(group.TargetGroupArn),
+			Protocol:      aws.StringValue(group.Protocol),
+			Port:          aws.Int64Value(group.Port),
+			TargetType:    aws.StringValue(group.TargetType),
+			LoadBalancers: []LoadBalancerV2{},
+		}
+		for _, arn := range group.LoadBalancerArns {
+			if balancer, found := balancersByArn[*arn]; found {
+				balancerInfo := LoadBalancerV2{
+					Name:    aws.StringValue(balancer.LoadBalancerName),
+					Arn:     aws.StringValue(balancer.LoadBalancerArn),
+					Type:    aws.StringValue(balancer.Type),
+					Scheme:  aws.StringValue(balancer.Scheme),
+					DNSName: aws.StringValue(balancer.DNSName),
+				}
+				if balancer.State != nil {
+					balancerInfo.State = aws.StringValue(balancer.State.Code)
+				}
+				info.LoadBalancers = append(info.LoadBalancers, balancerInfo)
+			}
+		}
+		if info.Targets, err = getTargets(clients.ELBV2, info.Arn); err != nil {
+			return nil, err
+		}
+		groups = append(groups, info)
+	}
+	return groups, nil
+}
+
+//
+// Prints the target group details fetched by GetTargetGroups.
+//
+func PrintTargetGroups(groups []TargetGroupInfo) {
+	if len(groups) > 0 {
+		fmt.Println("")
+		PrintSeparator()
+		for _, group := range groups {
+			fmt.Printf("  Target Group: %s (%s port %d, target type %s)\n", group.Name, group.Protocol, group.Port, group.TargetType)
+			for _, balancer := range group.LoadBalancers {
+				fmt.Printf("  - Load Balancer: %s (%s, %s, %s)\n", balancer.Name, balancer.Type, balancer.Scheme, balancer.State)
+				fmt.Println("    DNSName:", balancer.DNSName)
+			}
+			if len(group.Targets) == 0 {
+				fmt.Println("  - No targets registered")
+			}
+			for _, target := range group.Targets {
+				fmt.Printf("  - Target: %s:%d %s\n", target.Id, target.Port, target.State)
+				if target.Description != "" {
+					fmt.Printf("    %s: %s\n", target.Reason, target.Description)
+				}
+			}
+		}
+	}
+}
+
+/////////////// Private functions
+
+// Fetch the targets registered with a target group and their health.
+func getTargets(elbv2Conn elbv2iface.ELBV2API, targetGroupArn string) ([]TargetInfo, error) {
+	output, err := elbv2Conn.DescribeTargetHealth(&elbv2.DescribeTargetHealthInput{TargetGroupArn: &targetGroupArn})
+	if err != nil {
+		return nil, apiError(fmt.Sprintf("fetching target health for %s", targetGroupName(targetGroupArn)), err)
+	}
+	var targets = make([]TargetInfo, 0)
+	for _, description := range output.TargetHealthDescriptions {
+		target := TargetInfo{
+			Id:   aws.StringValue(description.Target.Id),
+			Port: aws.Int64Value(description.Target.Port),
+		}
+		if description.TargetHealth != nil {
+			target.State = aws.StringValue(description.TargetHealth.State)
+			target.Reason = aws.StringValue(description.TargetHealth.Reason)
+			target.Description = aws.StringValue(description.TargetHealth.Description)
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// Given a target group ARN, such as
+// "arn:aws:elasticloadbalancing:us-west-2:751992077663:targetgroup/my-api/6d0ecf831eec9f09"
+// Return the target group's name, e.g. "my-api"
+func targetGroupName(targetGroupArn string) string {
+	splits := str.Split(targetGroupArn, "/")
+	if len(splits) > 1 {
+		return splits[1]
+	}
+	return targetGroupArn
+}
@@ -0,0 +1,49 @@
+package components
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestGetTargetGroups(t *testing.T) {
+	fake := newFakeECS()
+	api := fake.elbv2.addTargetGroup("api", "healthy", "unhealthy")
+	web := fake.elbv2.addTargetGroup("web")
+
+	groups, err := GetTargetGroups(fake.clients(), []*string{aws.String(api), aws.String(web), aws.String(api)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 2 || groups[0].Name != "api" || groups[1].Name != "web" {
+		t.Fatalf("got target groups %+v, want api and web once each", groups)
+	}
+	apiGroup := groups[0]
+	if len(apiGroup.LoadBalancers) != 1 || apiGroup.LoadBalancers[0].Type != "application" || apiGroup.LoadBalancers[0].State != "active" {
+		t.Errorf("api has load balancers %+v", apiGroup.LoadBalancers)
+	}
+	want := []TargetInfo{
+		{Id: "10.0.1.1", Port: 8080, State: "healthy"},
+		{Id: "10.0.1.2", Port: 8080, State: "unhealthy", Reason: "Target.FailedHealthChecks",
+			Description: "Health checks failed with these codes: [502]"},
+	}
+	if !reflect.DeepEqual(apiGroup.Targets, want) {
+		t.Errorf("api has targets %+v, want %+v", apiGroup.Targets, want)
+	}
+	if groups[1].Targets == nil || len(groups[1].Targets) != 0 {
+		t.Errorf("web should have an empty list of targets, got %v", groups[1].Targets)
+	}
+
+	groups, err = GetTargetGroups(fake.clients(), nil)
+	if err != nil || groups == nil || len(groups) != 0 {
+		t.Errorf("no target groups returned %v, %v", groups, err)
+	}
+}
+
+func TestTargetGroupName(t *testing.T) {
+	arn := "arn:aws:elasticloadbalancing:us-west-2:751992077663:targetgroup/my-api/6d0ecf831eec9f09"
+	if name := targetGroupName(arn); name != "my-api" {
+		t.Errorf("targetGroupName(%q) = %q, want my-api", arn, name)
+	}
+}
@@ -9,34 +9,151 @@ import str "strings"
 import (
 	"fmt"
 	"io/ioutil"
-	"os"
+	"reflect"
+	"sort"
+	"strconv"
 
 	"encoding/json"
 
-	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
 )
 
 //
-// Function to print the details of a service's task definition, since it's got a lot of fiddly details.
+// TaskDefinitionInfo describes a task definition and its containers.
+//
+type TaskDefinitionInfo struct {
+	Arn        string          `json:"arn"`
+	Family     string          `json:"family"`
+	Revision   int64           `json:"revision"`
+	Containers []ContainerInfo `json:"containers"`
+}
+
+// ContainerInfo describes one container in a task definition.
+type ContainerInfo struct {
+	Name         string                `json:"name"`
+	Image        string                `json:"image"`
+	Cpu          int64                 `json:"cpu"`
+	Memory       int64                 `json:"memory"`
+	PortMappings []PortMappingInfo     `json:"portMappings"`
+	Command      []string              `json:"command"`
+	EntryPoint   []string              `json:"entryPoint"`
+	Environment  []EnvironmentVariable `json:"environment"`
+}
+
+// PortMappingInfo is a container port and the host port it's mapped to, which is 0 for a dynamic port.
+type PortMappingInfo struct {
+	ContainerPort int64  `json:"containerPort"`
+	HostPort      int64  `json:"hostPort"`
+	Protocol      string `json:"protocol"`
+}
+
+// EnvironmentVariable is an environment variable set on a container.
+type EnvironmentVariable struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+//
+// TaskInfo describes a task. RevisionMismatch is set if the task isn't running the task definition revision its
+// service uses. Where the task can be reached is given by PrivateIP for awsvpc tasks, or by the container instance and
+// the host ports of its network bindings for tasks on EC2 instances.
+//
+type TaskInfo struct {
+	Arn                  string               `json:"arn"`
+	TaskDefinition       string               `json:"taskDefinition"`
+	DesiredStatus        string               `json:"desiredStatus"`
+	LastStatus           string               `json:"lastStatus"`
+	RevisionMismatch     bool                 `json:"revisionMismatch"`
+	ContainerInstanceArn string               `json:"containerInstanceArn,omitempty"`
+	PrivateIP            string               `json:"privateIp,omitempty"`
+	NetworkBindings      []NetworkBindingInfo `json:"networkBindings,omitempty"`
+}
+
+// NetworkBindingInfo is a container port of a task and the host port it's bound to.
+type NetworkBindingInfo struct {
+	ContainerName string `json:"containerName"`
+	ContainerPort int64  `json:"containerPort"`
+	HostPort      int64  `json:"hostPort"`
+}
+
+//
+// TaskDefinitionList is the result of listing task definitions: either the families with their latest revisions, or
+// the details of the task definitions in one family.
+//
+type TaskDefinitionList struct {
+	Families        []TaskFamily         `json:"families,omitempty"`
+	TaskDefinitions []TaskDefinitionInfo `json:"taskDefinitions,omitempty"`
+}
+
+// TaskFamily is a task definition family and its latest revision.
+type TaskFamily struct {
+	Family         string `json:"family"`
+	LatestRevision int64  `json:"latestRevision"`
+}
+
+//
+// Function to fetch the details of a task definition, since it's got a lot of fiddly details.
 //
-func PrintTaskDefinition(awsConn *ecs.ECS, taskDefinition *string, verboseFlag bool) {
+func GetTaskDefinition(awsConn ecsiface.ECSAPI, taskDefinition string) (*TaskDefinitionInfo, error) {
 	// Fetch the details of the task definition.
 	taskDef, err := awsConn.DescribeTaskDefinition(&ecs.DescribeTaskDefinitionInput{
-		TaskDefinition: taskDefinition,
+		TaskDefinition: &taskDefinition,
 	})
-	CheckError(fmt.Sprintf("fetching Task Definition for %s", *taskDefinition), err)
-	fmt.Println("  - Task Definition:", *taskDefinition)
-	fmt.Println("    - Family:", *taskDef.TaskDefinition.Family)
+	if err != nil {
+		return nil, apiError(fmt.Sprintf("fetching Task Definition for %s", taskDefinition), err)
+	}
+	info := &TaskDefinitionInfo{
+		Arn:        taskDefinition,
+		Family:     *taskDef.TaskDefinition.Family,
+		Revision:   *taskDef.TaskDefinition.Revision,
+		Containers: []ContainerInfo{},
+	}
 	for _, containerDef := range taskDef.TaskDefinition.ContainerDefinitions {
+		container := ContainerInfo{
+			Name:         aws.StringValue(containerDef.Name),
+			Image:        aws.StringValue(containerDef.Image),
+			Cpu:          aws.Int64Value(containerDef.Cpu),
+			Memory:       aws.Int64Value(containerDef.Memory),
+			PortMappings: []PortMappingInfo{},
+			Command:      aws.StringValueSlice(containerDef.Command),
+			EntryPoint:   aws.StringValueSlice(containerDef.EntryPoint),
+			Environment:  []EnvironmentVariable{},
+		}
+		for _, portMap := range containerDef.PortMappings {
+			container.PortMappings = append(container.PortMappings, PortMappingInfo{
+				ContainerPort: aws.Int64Value(portMap.ContainerPort),
+				HostPort:      aws.Int64Value(portMap.HostPort),
+				Protocol:      aws.StringValue(portMap.Protocol),
+			})
+		}
+		for _, envVariable := range containerDef.Environment {
+			container.Environment = append(container.Environment, EnvironmentVariable{
+				Name:  aws.StringValue(envVariable.Name),
+				Value: aws.StringValue(envVariable.Value),
+			})
+		}
+		info.Containers = append(info.Containers, container)
+	}
+	return info, nil
+}
+
+//
+// Function to print the details of a service's task definition, since it's got a lot of fiddly details.
+//
+func PrintTaskDefinition(taskDef *TaskDefinitionInfo, verboseFlag bool) {
+	fmt.Println("  - Task Definition:", taskDef.Arn)
+	fmt.Println("    - Family:", taskDef.Family)
+	for _, containerDef := range taskDef.Containers {
 		fmt.Println("    - Container Definition:")
-		fmt.Println("      - Image:", *containerDef.Image)
+		fmt.Println("      - Image:", containerDef.Image)
 		if verboseFlag {
-			fmt.Println("      - CPU:", *containerDef.Cpu)
-			fmt.Println("      - Memory:", *containerDef.Memory)
+			fmt.Println("      - CPU:", containerDef.Cpu)
+			fmt.Println("      - Memory:", containerDef.Memory)
 		}
 		for _, portMap := range containerDef.PortMappings {
-			fmt.Println("      - Container Port", *portMap.ContainerPort, ": Host Port", *portMap.HostPort)
+			fmt.Println("      - Container Port", portMap.ContainerPort, ": Host Port", portMap.HostPort)
 		}
 		if len(containerDef.Command) > 0 {
 			fmt.Printf("      - Command: %v\n", containerDef.Command)
@@ -47,62 +164,81 @@ func PrintTaskDefinition(awsConn *ecs.ECS, taskDefinition *string, verboseFlag b
 		if (len(containerDef.Environment) > 0) && (verboseFlag) {
 			fmt.Println("      - Environment:")
 			for _, envVariable := range containerDef.Environment {
-				fmt.Println("       ", *envVariable.Name, "=", *envVariable.Value)
+				fmt.Println("       ", envVariable.Name, "=", envVariable.Value)
 			}
 		}
 	}
 }
 
 //
-// Print information about the tasks associated with the specific service.
+// Print a registered task definition as JSON in the layout that register accepts, so it can be saved to a file and
+// kept in version control. The task definition can be a family, family:revision or ARN. Fields that AWS manages, such
+// as the revision, status, requiresAttributes and ARNs, are left out. Nothing else is printed, so the output can be
+// redirected straight into a file.
 //
-func PrintServiceTasks(awsConn *ecs.ECS, clusterName string, serviceName string, taskDefinition string) {
-	taskRevision := getRevisionFromTaskDefinition(taskDefinition)
-	tasks := getServiceTasks(awsConn, clusterName, serviceName)
-	for _, task := range tasks {
-		fmt.Println("  - Task", *task.TaskArn)
-		fmt.Println("    Task Def:", *task.TaskDefinitionArn)
-		fmt.Println("    Desired status", *task.DesiredStatus, "- Last status", *task.LastStatus)
-		if taskRevision != getRevisionFromTaskDefinition(*task.TaskDefinitionArn) {
-			fmt.Println("    *** WARNING: task does not have the same task/revision as the service definition ***")
-		}
+func ExportTaskDefinition(clients *Clients, taskDefinition string) error {
+	awsConn := clients.ECS
+	taskDef, err := awsConn.DescribeTaskDefinition(&ecs.DescribeTaskDefinitionInput{
+		TaskDefinition: &taskDefinition,
+		Include:        []*string{aws.String(ecs.TaskDefinitionFieldTags)},
+	})
+	if err != nil {
+		return apiError(fmt.Sprintf("fetching Task Definition for %s", taskDefinition), err)
 	}
+	taskDefinitionText, err := taskDefinitionJSON(registerInputFromTaskDefinition(taskDef.TaskDefinition, taskDef.Tags))
+	if err != nil {
+		return err
+	}
+	// register fills in ${NAME} template variables, so escape any the task definition has of its own.
+	fmt.Println(escapeTemplate(taskDefinitionText))
+	return nil
 }
 
-func CheckServiceTasks(awsConn *ecs.ECS, clusterName string,
-	serviceName string, verboseFlag bool, serviceTaskDefinition string) ([]string, int) {
-	taskWarnings := make([]string, 0)
+//
+// Fetch the tasks associated with the service and compare them with the service's task definition and desired count.
+// Returns the tasks, findings about anything that looks wrong, and the number of tasks that are running. A service
+// with no tasks running is CRITICAL unless it's meant to have none, and one with fewer running than it wants, or with
+// tasks on another revision, is a WARNING.
+//
+func CheckServiceTasks(awsConn ecsiface.ECSAPI, clusterName string,
+	serviceName string, serviceTaskDefinition string, desiredCount int64) ([]TaskInfo, []CheckFinding, int, error) {
+	taskFindings := make([]CheckFinding, 0)
 
 	serviceTaskRevision := getRevisionFromTaskDefinition(serviceTaskDefinition)
-	tasks := getServiceTasks(awsConn, clusterName, serviceName)
+	tasks, err := getServiceTasks(awsConn, clusterName, serviceName)
+	if err != nil {
+		return nil, nil, 0, err
+	}
 
+	var taskInfos = make([]TaskInfo, 0)
 	var taskRunning = 0
 	for _, task := range tasks {
-		if verboseFlag {
-			taskWarnings = append(taskWarnings, fmt.Sprintln("  - Task", *task.TaskArn))
-			taskWarnings = append(taskWarnings, fmt.Sprintln("    Task Def:", *task.TaskDefinitionArn))
-			taskWarnings = append(taskWarnings, fmt.Sprintln("    Desired status", *task.DesiredStatus, "- Last status", *task.LastStatus))
-		}
-		if *task.LastStatus == "RUNNING" {
+		taskInfo := newTaskInfo(task, serviceTaskDefinition)
+		taskInfos = append(taskInfos, taskInfo)
+		if taskInfo.LastStatus == "RUNNING" {
 			taskRunning += 1
 		}
-		taskRevision := getRevisionFromTaskDefinition(*task.TaskDefinitionArn)
-		if serviceTaskRevision != taskRevision {
-			taskWarnings = append(taskWarnings, fmt.Sprintln("WARNING: task uses", taskRevision, "but service definition is", serviceTaskRevision))
+		if taskInfo.RevisionMismatch {
+			taskFindings = append(taskFindings, CheckFinding{SeverityWarning, fmt.Sprint("task uses ",
+				getRevisionFromTaskDefinition(taskInfo.TaskDefinition), " but service definition is ", serviceTaskRevision)})
 		}
 	}
-	if taskRunning == 0 {
-		taskWarnings = append(taskWarnings, fmt.Sprintln("WARNING: No tasks in RUNNING state for the service"))
+	if taskRunning == 0 && desiredCount > 0 {
+		taskFindings = append(taskFindings, CheckFinding{SeverityCritical,
+			fmt.Sprintf("No tasks in RUNNING state for the service, %d desired", desiredCount)})
+	} else if int64(taskRunning) < desiredCount {
+		taskFindings = append(taskFindings, CheckFinding{SeverityWarning,
+			fmt.Sprintf("only %d of %d desired tasks running", taskRunning, desiredCount)})
 	}
-	return taskWarnings, taskRunning
+	return taskInfos, taskFindings, taskRunning, nil
 }
 
 //
 // Run a task - runs 1 instance of the specified task.
 //
-func RunTask(creds *credentials.Credentials, region string, clusterName string, taskName string) {
+func RunTask(clients *Clients, clusterName string, taskName string) error {
 	fmt.Println("Running one instance of task", taskName)
-	awsConn := GetEcsConnection(creds, region)
+	awsConn := clients.ECS
 	var startedBy = "ecsman"
 	var runCount = int64(1)
 	runTaskOutput, err := awsConn.RunTask(&ecs.RunTaskInput{
@@ -111,7 +247,9 @@ func RunTask(creds *credentials.Credentials, region string, clusterName string,
 		StartedBy:      &startedBy,
 		TaskDefinition: &taskName,
 	})
-	CheckError("running task", err)
+	if err != nil {
+		return apiError("running task", err)
+	}
 	for _, fail := range runTaskOutput.Failures {
 		fmt.Println("  FAILED Task:", *fail.Arn)
 		fmt.Println("  - Error:", *fail.Reason)
@@ -125,169 +263,436 @@ func RunTask(creds *credentials.Credentials, region string, clusterName string,
 		fmt.Printf("  - Task Running on container(s) %v\n", containerNames)
 		fmt.Println("  - Last known status:", *task.LastStatus)
 	}
+	return nil
 }
 
 //
-// Print the task definitions
+// Fetch the task definitions. With no family, it lists the families with the latest revision of each. With a family,
+// it fetches the details of the family's task definitions: all of them, the given revision, or the latest revision if
+// taskRevision is "latest".
 //
-func PrintTasks(creds *credentials.Credentials, region string, taskFamily string, taskRevision string) {
+func ListTaskDefinitions(clients *Clients, taskFamily string, taskRevision string) (*TaskDefinitionList, error) {
 	var wantedRevision string
 	if taskRevision == "latest" {
 		wantedRevision = "latest"
 	} else {
 		wantedRevision = fmt.Sprintf("%s:%s", taskFamily, taskRevision)
 	}
-	awsConn := GetEcsConnection(creds, region)
+	awsConn := clients.ECS
 	listInput := ecs.ListTaskDefinitionsInput{}
 	if taskFamily != "" {
 		listInput.FamilyPrefix = &taskFamily
 	}
-	taskDefList, err := awsConn.ListTaskDefinitions(&listInput)
-	CheckError("fetching task definitions list", err)
+	taskDefinitionArns, err := listTaskDefinitionArns(awsConn, &listInput)
+	if err != nil {
+		return nil, err
+	}
 
-	families := map[string]string{}
-	for taskIndex, taskdef := range taskDefList.TaskDefinitionArns {
+	list := &TaskDefinitionList{}
+	families := map[string]int64{}
+	for taskIndex, taskdef := range taskDefinitionArns {
 		revision := getRevisionFromTaskDefinition(*taskdef)
-		if taskFamily == "" { // Print a list of the families
-			splitRevision := str.Split(revision, ":")
-			families[splitRevision[0]] = splitRevision[1]
+		if taskFamily == "" { // Make a list of the families
+			family, number := splitRevision(revision)
+			if number > families[family] {
+				families[family] = number
+			}
 		} else {
+			var wanted bool
 			if wantedRevision == "latest" {
-				if taskIndex+1 == len(taskDefList.TaskDefinitionArns) {
-					PrintTaskDefinition(awsConn, taskdef, true)
-				}
+				wanted = taskIndex+1 == len(taskDefinitionArns)
 			} else {
-				if (taskRevision == "") || (wantedRevision == revision) {
-					PrintTaskDefinition(awsConn, taskdef, true)
+				wanted = (taskRevision == "") || (wantedRevision == revision)
+			}
+			if wanted {
+				info, err := GetTaskDefinition(awsConn, *taskdef)
+				if err != nil {
+					return nil, err
 				}
+				list.TaskDefinitions = append(list.TaskDefinitions, *info)
 			}
 		}
 	}
 	if taskFamily == "" {
-		fmt.Println("Task Definition families:")
+		list.Families = []TaskFamily{}
 		for family, rev := range families {
-			fmt.Printf("  %s (latest revision: %s)\n", family, rev)
+			list.Families = append(list.Families, TaskFamily{Family: family, LatestRevision: rev})
 		}
+		sort.Slice(list.Families, func(a, b int) bool { return list.Families[a].Family < list.Families[b].Family })
+	} else if list.TaskDefinitions == nil {
+		list.TaskDefinitions = []TaskDefinitionInfo{}
 	}
+	return list, nil
 }
 
 //
-// TaskDefn is a struct defining the layout of the Task Definition JSON file.
-// This is used in order to parse the JSON file directly into a usable structure.
+// Print the task definitions fetched by ListTaskDefinitions.
 //
-type TaskDefn struct {
-	ContainerDefinitions []struct {
-		Command      []string
-		CPU          int64
-		EntryPoint   []string
-		Environment  []ecs.KeyValuePair
-		Essential    bool
-		Image        string
-		Memory       int64
-		Name         string
-		PortMappings []ecs.PortMapping
+func PrintTasks(list *TaskDefinitionList) {
+	for index := range list.TaskDefinitions {
+		PrintTaskDefinition(&list.TaskDefinitions[index], true)
+	}
+	if list.Families != nil {
+		fmt.Println("Task Definition families:")
+		for _, family := range list.Families {
+			fmt.Printf("  %s (latest revision: %d)\n", family.Family, family.LatestRevision)
+		}
 	}
-	Family string
 }
 
 //
-// Read a task definition from JSON file and register it.
+// Read a task definition from a JSON or YAML file and register it. The format is taken from the file extension unless
+// format is set. The file can use ${NAME} template variables, which are filled in from vars or the environment.
+// Returns the ARN of the registered task definition.
 //
-func CreateTask(creds *credentials.Credentials, region string, taskFile string) {
+func CreateTask(clients *Clients, taskFile string, format string, vars map[string]string) (string, error) {
 	fmt.Printf("Registering Task Definition...\n\n")
-	// Create a client connection object.
-	awsConn := GetEcsConnection(creds, region)
+	awsConn := clients.ECS
 
-	// Pass the file in and get back the parsed container definition and the task family string
-	containerDefinition, taskFamily := makeTaskDefinition(taskFile)
+	// Pass the file in and get back the parsed task definition, ready to register.
+	taskDefinition, err := makeTaskDefinition(taskFile, format, vars)
+	if err != nil {
+		return "", err
+	}
+	return registerTaskDefinition(awsConn, taskDefinition)
+}
 
-	containerDefs := []*ecs.ContainerDefinition{&containerDefinition}
-	taskDefinitionOutput, err := awsConn.RegisterTaskDefinition(&ecs.RegisterTaskDefinitionInput{
-		ContainerDefinitions: containerDefs,
-		Family:               &taskFamily,
-	})
-	CheckError("registering task definition", err)
+//
+// Register a task definition and print a summary of what was registered. Returns the new task definition's ARN.
+//
+func registerTaskDefinition(awsConn ecsiface.ECSAPI, taskDefinition *ecs.RegisterTaskDefinitionInput) (string, error) {
+	taskDefinitionOutput, err := awsConn.RegisterTaskDefinition(taskDefinition)
+	if err != nil {
+		return "", apiError("registering task definition", err)
+	}
 
 	fmt.Println("Registered new Task Definition:")
 	fmt.Println("  - Family:", *taskDefinitionOutput.TaskDefinition.Family)
 	fmt.Println("  - Revision:", *taskDefinitionOutput.TaskDefinition.Revision)
 	fmt.Println("  - Status:", *taskDefinitionOutput.TaskDefinition.Status)
+	for _, container := range taskDefinitionOutput.TaskDefinition.ContainerDefinitions {
+		fmt.Println("  - Container:", *container.Name)
+		for _, dependency := range container.DependsOn {
+			fmt.Println("    Depends on:", *dependency.ContainerName, "to", *dependency.Condition)
+		}
+	}
+	return *taskDefinitionOutput.TaskDefinition.TaskDefinitionArn, nil
 }
 
 //
-// Called by createTask() above. Given a filename, parse the JSON file and create a ContainerDefinition
-// struct that can be passed to the SDK to create the task definition.
+// Called by createTask() above. Given a filename, parse the JSON or YAML file into the input for registering a task
+// definition. The file has the same layout that `aws ecs register-task-definition --cli-input-json` takes, so any field
+// ECS supports can be used. Keys that aren't part of that layout are reported as errors rather than silently dropped.
 //
-func makeTaskDefinition(taskFile string) (ecs.ContainerDefinition, string) {
-	var taskJSON TaskDefn
-	// Do it the easy way and read in the whole file. A JSON file's not going to be very large.
-	fileBytes, err := ioutil.ReadFile(taskFile)
-	CheckError(fmt.Sprintf("Error reading task file %s", taskFile), err)
-	err = json.Unmarshal(fileBytes, &taskJSON)
-	CheckError(fmt.Sprintf("Error reading task file %s", taskFile), err)
-	// TODO: Support more than one if it's ever needed.
-	if len(taskJSON.ContainerDefinitions) > 1 {
-		fmt.Println("Right now I only support a single ContainerDefinition, sorry. Please edit and try again.")
-		os.Exit(1)
-	}
-
-	// Now let's construct our Container Definition object, which is a lot of boring copying of fields.
-	var defn ecs.ContainerDefinition
-	defn.Cpu = &taskJSON.ContainerDefinitions[0].CPU
-	var commands = make([]*string, 0)
-	for i := 0; i < len(taskJSON.ContainerDefinitions[0].Command); i++ {
-		commands = append(commands, &taskJSON.ContainerDefinitions[0].Command[i])
-	}
-	defn.Command = commands
-	var entrypoints = make([]*string, 0)
-	for i := 0; i < len(taskJSON.ContainerDefinitions[0].EntryPoint); i++ {
-		entrypoints = append(entrypoints, &taskJSON.ContainerDefinitions[0].EntryPoint[i])
-	}
-	defn.EntryPoint = entrypoints
-	var environments = make([]*ecs.KeyValuePair, 0)
-	for i := 0; i < len(taskJSON.ContainerDefinitions[0].Environment); i++ {
-		var keyval ecs.KeyValuePair
-		keyval.Name = taskJSON.ContainerDefinitions[0].Environment[i].Name
-		keyval.Value = taskJSON.ContainerDefinitions[0].Environment[i].Value
-		environments = append(environments, &keyval)
-	}
-	defn.Environment = environments
-	defn.Essential = &taskJSON.ContainerDefinitions[0].Essential
-	defn.Image = &taskJSON.ContainerDefinitions[0].Image
-	defn.Memory = &taskJSON.ContainerDefinitions[0].Memory
-	defn.Name = &taskJSON.ContainerDefinitions[0].Name
-	var ports = make([]*ecs.PortMapping, 0)
-	for i := 0; i < len(taskJSON.ContainerDefinitions[0].PortMappings); i++ {
-		var portmap ecs.PortMapping
-		portmap.ContainerPort = taskJSON.ContainerDefinitions[0].PortMappings[i].ContainerPort
-		portmap.HostPort = taskJSON.ContainerDefinitions[0].PortMappings[i].HostPort
-		ports = append(ports, &portmap)
-	}
-	defn.PortMappings = ports
-	return defn, taskJSON.Family
+func makeTaskDefinition(taskFile string, format string, vars map[string]string) (*ecs.RegisterTaskDefinitionInput, error) {
+	fileBytes, format, err := readTaskFile(taskFile, format, vars)
+	if err != nil {
+		return nil, err
+	}
+	jsonBytes, err := taskFileJSON(fileBytes, format)
+	if err != nil {
+		return nil, &ValidationError{Message: fmt.Sprintf("parsing task file %s: %v", taskFile, err)}
+	}
+	taskDefinition, unknownKeys, err := parseTaskDefinition(jsonBytes)
+	if err != nil {
+		return nil, &ValidationError{Message: fmt.Sprintf("parsing task file %s: %v", taskFile, err)}
+	}
+	if len(unknownKeys) > 0 {
+		return nil, &ValidationError{
+			Message:  fmt.Sprintf("task file %s has keys that aren't part of a task definition", taskFile),
+			Problems: unknownKeys,
+		}
+	}
+	if problems := checkContainerDependencies(taskDefinition.ContainerDefinitions); len(problems) > 0 {
+		return nil, &ValidationError{
+			Message:  fmt.Sprintf("task file %s has problems with container dependencies", taskFile),
+			Problems: problems,
+		}
+	}
+	return taskDefinition, nil
 }
 
 /////////////// Private functions
 
+//
+// Build the input for registering a copy of a task definition, carrying over every field that can be registered
+// along with its tags. The read-only fields that AWS manages, such as the revision, status and ARN, are left out.
+//
+func registerInputFromTaskDefinition(taskDef *ecs.TaskDefinition, tags []*ecs.Tag) *ecs.RegisterTaskDefinitionInput {
+	input := &ecs.RegisterTaskDefinitionInput{
+		ContainerDefinitions:    taskDef.ContainerDefinitions,
+		Cpu:                     taskDef.Cpu,
+		EphemeralStorage:        taskDef.EphemeralStorage,
+		ExecutionRoleArn:        taskDef.ExecutionRoleArn,
+		Family:                  taskDef.Family,
+		InferenceAccelerators:   taskDef.InferenceAccelerators,
+		IpcMode:                 taskDef.IpcMode,
+		Memory:                  taskDef.Memory,
+		NetworkMode:             taskDef.NetworkMode,
+		PidMode:                 taskDef.PidMode,
+		PlacementConstraints:    taskDef.PlacementConstraints,
+		ProxyConfiguration:      taskDef.ProxyConfiguration,
+		RequiresCompatibilities: taskDef.RequiresCompatibilities,
+		RuntimePlatform:         taskDef.RuntimePlatform,
+		TaskRoleArn:             taskDef.TaskRoleArn,
+		Volumes:                 taskDef.Volumes,
+	}
+	// Leave the tags out entirely rather than sending an empty list.
+	if len(tags) > 0 {
+		input.Tags = tags
+	}
+	return input
+}
+
 //
 // Given a service, fetches the tasks associated with it and returns them in an array.
 //
-func getServiceTasks(awsConn *ecs.ECS, clusterName string, serviceName string) []*ecs.Task {
-	taskOutput, err := awsConn.ListTasks(&ecs.ListTasksInput{
+func getServiceTasks(awsConn ecsiface.ECSAPI, clusterName string, serviceName string) ([]*ecs.Task, error) {
+	taskArns, err := listTaskArns(awsConn, &ecs.ListTasksInput{
 		Cluster:     &clusterName,
 		ServiceName: &serviceName,
 	})
-	CheckError("fetching task list for service", err)
-	var serviceTasks []*ecs.Task
-	if len(taskOutput.TaskArns) > 0 {
-		taskInfo, err := awsConn.DescribeTasks(&ecs.DescribeTasksInput{
-			Tasks:   taskOutput.TaskArns,
-			Cluster: &clusterName,
-		})
-		CheckError("fetching task data for service", err)
-		serviceTasks = taskInfo.Tasks
-	}
-	return serviceTasks
+	if err != nil {
+		return nil, err
+	}
+	return describeTasks(awsConn, clusterName, taskArns)
+}
+
+//
+// Check the dependsOn entries between a task's containers: every dependency has to name another container in the task,
+// use a condition ECS knows about, and the dependencies can't loop. A HEALTHY condition also needs the container it
+// waits for to have a health check. Returns a description of each problem found.
+//
+func checkContainerDependencies(containers []*ecs.ContainerDefinition) []string {
+	var problems []string
+	byName := map[string]*ecs.ContainerDefinition{}
+	for _, container := range containers {
+		if container.Name != nil {
+			byName[*container.Name] = container
+		}
+	}
+	for _, container := range containers {
+		if container.Name == nil {
+			continue
+		}
+		for _, dependency := range container.DependsOn {
+			if dependency.ContainerName == nil || dependency.Condition == nil {
+				problems = append(problems, fmt.Sprintf("container %s has a dependency without a containerName and condition", *container.Name))
+				continue
+			}
+			target, found := byName[*dependency.ContainerName]
+			switch {
+			case !found:
+				problems = append(problems, fmt.Sprintf("container %s depends on unknown container %s", *container.Name, *dependency.ContainerName))
+			case target == container:
+				problems = append(problems, fmt.Sprintf("container %s depends on itself", *container.Name))
+			case !validDependencyCondition(*dependency.Condition):
+				problems = append(problems, fmt.Sprintf("container %s has unknown dependency condition %s, expected one of %v",
+					*container.Name, *dependency.Condition, ecs.ContainerCondition_Values()))
+			case *dependency.Condition == ecs.ContainerConditionHealthy && target.HealthCheck == nil:
+				problems = append(problems, fmt.Sprintf("container %s waits for %s to be HEALTHY but %s has no health check",
+					*container.Name, *dependency.ContainerName, *dependency.ContainerName))
+			}
+		}
+	}
+	if cycle := findDependencyCycle(containers, byName); cycle != nil {
+		problems = append(problems, fmt.Sprintf("container dependencies loop: %s", str.Join(cycle, " -> ")))
+	}
+	return problems
+}
+
+// Whether a dependsOn condition is one that ECS accepts.
+func validDependencyCondition(condition string) bool {
+	for _, known := range ecs.ContainerCondition_Values() {
+		if condition == known {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// Look for a loop in the containers' dependsOn entries with a depth-first search. Returns the names of the containers
+// making up the first loop found, starting and ending with the same container, or nil if there isn't one.
+//
+func findDependencyCycle(containers []*ecs.ContainerDefinition, byName map[string]*ecs.ContainerDefinition) []string {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := map[string]int{}
+	var path []string
+	var visit func(name string) []string
+	visit = func(name string) []string {
+		state[name] = visiting
+		path = append(path, name)
+		for _, dependency := range byName[name].DependsOn {
+			if dependency.ContainerName == nil {
+				continue
+			}
+			next := *dependency.ContainerName
+			if _, found := byName[next]; !found || next == name {
+				continue // Reported separately
+			}
+			switch state[next] {
+			case visiting:
+				for index, step := range path {
+					if step == next {
+						return append(append([]string{}, path[index:]...), next)
+					}
+				}
+			case unvisited:
+				if cycle := visit(next); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = done
+		return nil
+	}
+	for _, container := range containers {
+		if container.Name != nil && state[*container.Name] == unvisited {
+			if cycle := visit(*container.Name); cycle != nil {
+				return cycle
+			}
+		}
+	}
+	return nil
+}
+
+//
+// Read a task definition file and fill in its template variables. Returns the contents along with the file's format,
+// which comes from the format given or else the file extension.
+//
+func readTaskFile(taskFile string, format string, vars map[string]string) ([]byte, string, error) {
+	format, err := taskFileFormat(taskFile, format)
+	if err != nil {
+		return nil, "", err
+	}
+	// Do it the easy way and read in the whole file. A task file's not going to be very large.
+	fileBytes, err := ioutil.ReadFile(taskFile)
+	if err != nil {
+		return nil, "", fmt.Errorf("reading task file %s: %w", taskFile, err)
+	}
+	fileBytes, err = expandTemplate(fileBytes, vars)
+	if err != nil {
+		return nil, "", &ValidationError{Message: fmt.Sprintf("filling in task file %s: %v", taskFile, err)}
+	}
+	return fileBytes, format, nil
+}
+
+//
+// Parse the contents of a task definition file, in JSON. Returns the parsed input, plus the path of every key that isn't part of
+// the task definition schema, such as "containerDefinitions[0].ulimit".
+//
+func parseTaskDefinition(fileBytes []byte) (*ecs.RegisterTaskDefinitionInput, []string, error) {
+	// The SDK's field names match the API's JSON names apart from the case of the first letter, and encoding/json
+	// ignores case when matching keys, so the file can be decoded straight into the SDK's input struct.
+	var taskDefinition ecs.RegisterTaskDefinitionInput
+	if err := json.Unmarshal(fileBytes, &taskDefinition); err != nil {
+		return nil, nil, err
+	}
+	// Decode it again generically, which can't fail now, to find the keys that were ignored.
+	var raw interface{}
+	json.Unmarshal(fileBytes, &raw)
+	return &taskDefinition, unknownFields(raw, reflect.TypeOf(taskDefinition), ""), nil
+}
+
+//
+// Walk a decoded JSON value alongside the type it was decoded into, and return the path of every object key that has no
+// matching field. Map contents such as docker labels and log options are free-form, so their keys aren't checked.
+//
+func unknownFields(raw interface{}, fieldType reflect.Type, path string) []string {
+	for fieldType.Kind() == reflect.Ptr {
+		fieldType = fieldType.Elem()
+	}
+	var unknown []string
+	switch value := raw.(type) {
+	case map[string]interface{}:
+		if fieldType.Kind() != reflect.Struct {
+			return nil
+		}
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			var keyPath = key
+			if path != "" {
+				keyPath = path + "." + key
+			}
+			field, found := fieldForKey(fieldType, key)
+			if !found {
+				unknown = append(unknown, keyPath)
+				continue
+			}
+			unknown = append(unknown, unknownFields(value[key], field.Type, keyPath)...)
+		}
+	case []interface{}:
+		if fieldType.Kind() != reflect.Slice {
+			return nil
+		}
+		for index, item := range value {
+			unknown = append(unknown, unknownFields(item, fieldType.Elem(), fmt.Sprintf("%s[%d]", path, index))...)
+		}
+	}
+	return unknown
+}
+
+// Find the struct field that encoding/json would decode the key into, ignoring case like it does.
+func fieldForKey(structType reflect.Type, key string) (reflect.StructField, bool) {
+	for index := 0; index < structType.NumField(); index++ {
+		field := structType.Field(index)
+		if field.PkgPath == "" && str.EqualFold(field.Name, key) {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+//
+// Print information about tasks associated with a service.
+//
+func printServiceTasks(tasks []TaskInfo) {
+	for _, task := range tasks {
+		fmt.Println("  - Task", task.Arn)
+		fmt.Println("    Task Def:", task.TaskDefinition)
+		fmt.Println("    Desired status", task.DesiredStatus, "- Last status", task.LastStatus)
+		if task.RevisionMismatch {
+			fmt.Println("    *** WARNING: task does not have the same task/revision as the service definition ***")
+		}
+	}
+}
+
+// Describe a task, noting whether it's running a different revision to the one its service uses.
+func newTaskInfo(task *ecs.Task, serviceTaskDefinition string) TaskInfo {
+	info := TaskInfo{
+		Arn:                  *task.TaskArn,
+		TaskDefinition:       *task.TaskDefinitionArn,
+		DesiredStatus:        *task.DesiredStatus,
+		LastStatus:           *task.LastStatus,
+		RevisionMismatch:     getRevisionFromTaskDefinition(serviceTaskDefinition) != getRevisionFromTaskDefinition(*task.TaskDefinitionArn),
+		ContainerInstanceArn: aws.StringValue(task.ContainerInstanceArn),
+	}
+	for _, container := range task.Containers {
+		// All the containers of an awsvpc task share its network interface.
+		for _, networkInterface := range container.NetworkInterfaces {
+			if info.PrivateIP == "" {
+				info.PrivateIP = aws.StringValue(networkInterface.PrivateIpv4Address)
+			}
+		}
+		for _, binding := range container.NetworkBindings {
+			info.NetworkBindings = append(info.NetworkBindings, NetworkBindingInfo{
+				ContainerName: aws.StringValue(container.Name),
+				ContainerPort: aws.Int64Value(binding.ContainerPort),
+				HostPort:      aws.Int64Value(binding.HostPort),
+			})
+		}
+	}
+	return info
 }
 
 // Given a task definition description, such as
@@ -301,3 +706,17 @@ func getRevisionFromTaskDefinition(taskDefinition string) string {
 		return "unknown"
 	}
 }
+
+// Split a "family:revision" string, as returned by getRevisionFromTaskDefinition, into the family and revision number.
+// The revision is -1 if it can't be parsed.
+func splitRevision(revision string) (string, int64) {
+	pos := str.LastIndex(revision, ":")
+	if pos == -1 {
+		return revision, -1
+	}
+	number, err := strconv.ParseInt(revision[pos+1:], 10, 64)
+	if err != nil {
+		return revision[:pos], -1
+	}
+	return revision[:pos], number
+}
@@ -0,0 +1,214 @@
+package components
+
+import str "strings"
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestGetRevisionFromTaskDefinition(t *testing.T) {
+	tests := map[string]string{
+		"arn:aws:ecs:us-west-2:751992077663:task-definition/demonstration:8": "demonstration:8",
+		"arn:aws:ecs:us-west-2:751992077663:task/prod/0123456789abcdef":      "0123456789abcdef",
+		"demonstration:8": "unknown",
+		"":                "unknown",
+	}
+	for taskDefinition, want := range tests {
+		if got := getRevisionFromTaskDefinition(taskDefinition); got != want {
+			t.Errorf("getRevisionFromTaskDefinition(%q) = %q, want %q", taskDefinition, got, want)
+		}
+	}
+}
+
+func TestCheckServiceTasks(t *testing.T) {
+	fake := newFakeECS()
+	old := fake.addTaskDefinition("api", fakeContainer("api", "acme/api:v1"))
+	current := fake.addTaskDefinition("api", fakeContainer("api", "acme/api:v2"))
+	fake.addTask("api", current, "RUNNING")
+	fake.addTask("api", old, "RUNNING")
+	fake.addTask("api", current, "PENDING")
+	fake.addTask("api", current, "STOPPED")
+	fake.addTask("worker", old, "RUNNING")
+
+	tasks, findings, running, err := CheckServiceTasks(fake, "prod", "api", current, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 3 || running != 2 {
+		t.Errorf("got %d tasks with %d running, want 3 with 2 running", len(tasks), running)
+	}
+	if !tasks[1].RevisionMismatch || tasks[0].RevisionMismatch || tasks[2].RevisionMismatch {
+		t.Errorf("only the second task should be marked as a mismatch: %+v", tasks)
+	}
+	want := []CheckFinding{{SeverityWarning, "task uses api:1 but service definition is api:2"}}
+	if !reflect.DeepEqual(findings, want) {
+		t.Errorf("findings %v, want %v", findings, want)
+	}
+}
+
+func TestCheckServiceTasksRunningCount(t *testing.T) {
+	fake := newFakeECS()
+	current := fake.addTaskDefinition("api", fakeContainer("api", "acme/api:v2"))
+	fake.addTask("api", current, "PENDING")
+	fake.addTask("api", current, "RUNNING")
+	fake.addTask("idle", current, "STOPPED")
+
+	tests := []struct {
+		service string
+		desired int64
+		want    []CheckFinding
+	}{
+		{"api", 1, []CheckFinding{}},
+		{"api", 3, []CheckFinding{{SeverityWarning, "only 1 of 3 desired tasks running"}}},
+		{"idle", 2, []CheckFinding{{SeverityCritical, "No tasks in RUNNING state for the service, 2 desired"}}},
+		{"idle", 0, []CheckFinding{}}, // Scaled down on purpose
+	}
+	for _, test := range tests {
+		_, findings, _, err := CheckServiceTasks(fake, "prod", test.service, current, test.desired)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(findings, test.want) {
+			t.Errorf("%s with %d desired: findings %v, want %v", test.service, test.desired, findings, test.want)
+		}
+	}
+}
+
+func TestListTaskDefinitions(t *testing.T) {
+	fake := newFakeECS()
+	for _, image := range []string{"v1", "v2", "v3"} {
+		fake.addTaskDefinition("api", fakeContainer("api", "acme/api:"+image))
+	}
+	fake.addTaskDefinition("worker", fakeContainer("worker", "acme/worker"))
+
+	tests := []struct {
+		revision string
+		want     []int64
+	}{
+		{"latest", []int64{3}},
+		{"2", []int64{2}},
+		{"", []int64{1, 2, 3}},
+		{"9", nil},
+	}
+	for _, test := range tests {
+		list, err := ListTaskDefinitions(fake.clients(), "api", test.revision)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var revisions []int64
+		for _, taskDef := range list.TaskDefinitions {
+			revisions = append(revisions, taskDef.Revision)
+		}
+		if !reflect.DeepEqual(revisions, test.want) {
+			t.Errorf("revision %q listed revisions %v, want %v", test.revision, revisions, test.want)
+		}
+	}
+
+	list, err := ListTaskDefinitions(fake.clients(), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []TaskFamily{{Family: "api", LatestRevision: 3}, {Family: "worker", LatestRevision: 1}}
+	if !reflect.DeepEqual(list.Families, want) {
+		t.Errorf("families %+v, want %+v", list.Families, want)
+	}
+}
+
+func TestMakeTaskDefinition(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ecsman")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFile := func(name string, contents string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	jsonFile := writeFile("api.json", `{
+  "family": "api",
+  "containerDefinitions": [
+    {"name": "api", "image": "acme/api:${TAG}", "memory": 256, "dependsOn": [{"containerName": "proxy", "condition": "START"}]},
+    {"name": "proxy", "image": "nginx", "dockerLabels": {"anything": "goes"}}
+  ]
+}`)
+	yamlFile := writeFile("api.yml", `
+family: api
+containerDefinitions:
+  - name: api
+    image: acme/api:${TAG}
+    memory: 256
+    dependsOn:
+      - containerName: proxy
+        condition: START
+  - name: proxy
+    image: nginx
+    dockerLabels:
+      anything: goes
+`)
+	for _, file := range []string{jsonFile, yamlFile} {
+		taskDefinition, err := makeTaskDefinition(file, "", map[string]string{"TAG": "v4"})
+		if err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		containers := taskDefinition.ContainerDefinitions
+		if *taskDefinition.Family != "api" || len(containers) != 2 {
+			t.Fatalf("%s: parsed family %s with %d containers", file, *taskDefinition.Family, len(containers))
+		}
+		if *containers[0].Image != "acme/api:v4" || *containers[0].Memory != 256 || *containers[0].DependsOn[0].ContainerName != "proxy" {
+			t.Errorf("%s: first container parsed as %v", file, containers[0])
+		}
+	}
+
+	var validation *ValidationError
+	tests := []struct {
+		name     string
+		contents string
+		problem  string // Expected in the error
+	}{
+		{"syntax.json", `{"family": "api",`, "parsing task file"},
+		{"syntax.yaml", "family: [api", "parsing task file"},
+		{"unknown.json", `{"family": "api", "containerDefinitions": [{"name": "api", "ulimit": []}]}`, "containerDefinitions[0].ulimit"},
+		{"cycle.json", `{"family": "api", "containerDefinitions": [
+			{"name": "a", "dependsOn": [{"containerName": "b", "condition": "START"}]},
+			{"name": "b", "dependsOn": [{"containerName": "a", "condition": "START"}]}]}`, "container dependencies"},
+		{"missing.json", `{"family": "api", "containerDefinitions": [{"name": "api", "image": "acme/api:${ECSMAN_TEST_UNSET}"}]}`, "${ECSMAN_TEST_UNSET} on line 1"},
+	}
+	for _, test := range tests {
+		_, err := makeTaskDefinition(writeFile(test.name, test.contents), "", nil)
+		if !errors.As(err, &validation) || !str.Contains(err.Error(), test.problem) {
+			t.Errorf("%s returned %v, want a ValidationError mentioning %q", test.name, err, test.problem)
+		}
+	}
+}
+
+func TestTemplateVariables(t *testing.T) {
+	os.Setenv("ECSMAN_TEST_TAG", "v9")
+	defer os.Unsetenv("ECSMAN_TEST_TAG")
+	vars, err := TemplateVars("", []string{"MEMORY=512"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Variables come from vars then the environment, and $${NAME} keeps a shell reference in a command.
+	file := `{"image": "acme/api:${ECSMAN_TEST_TAG}", "memory": ${MEMORY}, "command": ["sh", "-c", "cd $${HOME}"]}`
+	want := `{"image": "acme/api:v9", "memory": 512, "command": ["sh", "-c", "cd ${HOME}"]}`
+	expanded, err := expandTemplate([]byte(file), vars)
+	if err != nil || string(expanded) != want {
+		t.Errorf("expanded to %s with %v, want %s", expanded, err, want)
+	}
+
+	// What export prints comes back unchanged when it's registered, whatever variables are set.
+	exported := `{"command": ["echo ${MEMORY} ${ECSMAN_TEST_UNSET} $${HOME} $PATH"]}`
+	roundTrip, err := expandTemplate([]byte(escapeTemplate(exported)), vars)
+	if err != nil || string(roundTrip) != exported {
+		t.Errorf("escaped and expanded to %s with %v, want %s", roundTrip, err, exported)
+	}
+}
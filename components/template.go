@@ -0,0 +1,118 @@
+/*
+Variable substitution in task definition files, so one checked-in file can serve several environments.
+
+Womply, www.womply.com
+*/
+package components
+
+import str "strings"
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+)
+
+// Matches a ${NAME} reference in a task definition file, or $${NAME} which stands for a literal ${NAME}.
+var templateReference = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+//
+// Build the template variables from a vars file and a list of key=value assignments from the command line. The vars
+// file has one key=value per line, and blank lines and lines starting with # are skipped. Assignments from the command
+// line take precedence over the file. Either can be empty.
+//
+func TemplateVars(varsFile string, assignments []string) (map[string]string, error) {
+	vars := map[string]string{}
+	if varsFile != "" {
+		fileBytes, err := ioutil.ReadFile(varsFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading vars file %s: %w", varsFile, err)
+		}
+		for lineNumber, line := range str.Split(string(fileBytes), "\n") {
+			line = str.TrimSpace(line)
+			if line == "" || str.HasPrefix(line, "#") {
+				continue
+			}
+			key, value, ok := splitAssignment(line)
+			if !ok {
+				return nil, &ValidationError{Message: fmt.Sprintf("%s:%d: expected key=value, got %q", varsFile, lineNumber+1, line)}
+			}
+			vars[key] = value
+		}
+	}
+	for _, assignment := range assignments {
+		key, value, ok := splitAssignment(assignment)
+		if !ok {
+			return nil, &ValidationError{Message: fmt.Sprintf("expected -var key=value, got %q", assignment)}
+		}
+		vars[key] = value
+	}
+	return vars, nil
+}
+
+/////////////// Private functions
+
+//
+// Replace each ${NAME} in a task definition file with its value from vars, or from the environment if vars doesn't have
+// it. $${NAME} is replaced with a literal ${NAME}, which is how a shell reference such as ${HOME} in a container's
+// command is kept. Values are substituted as they are, so a value used inside a JSON string can't contain quotes. Any
+// variable without a value is an error, and the error lists all of them with the lines they're used on.
+//
+func expandTemplate(fileBytes []byte, vars map[string]string) ([]byte, error) {
+	var undefined []string
+	expanded := templateReference.ReplaceAllFunc(fileBytes, func(reference []byte) []byte {
+		if bytes.HasPrefix(reference, []byte("$$")) {
+			return reference[1:]
+		}
+		name := string(reference[2 : len(reference)-1])
+		if value, found := vars[name]; found {
+			return []byte(value)
+		}
+		if value, found := os.LookupEnv(name); found {
+			return []byte(value)
+		}
+		undefined = append(undefined, name)
+		return reference
+	})
+	if len(undefined) == 0 {
+		return expanded, nil
+	}
+
+	// Go back over the original to report where each undefined variable is used.
+	var missing []string
+	for lineNumber, line := range bytes.Split(fileBytes, []byte("\n")) {
+		for _, match := range templateReference.FindAllSubmatch(line, -1) {
+			if bytes.HasPrefix(match[0], []byte("$$")) {
+				continue
+			}
+			for _, name := range undefined {
+				if string(match[1]) == name {
+					missing = append(missing, fmt.Sprintf("${%s} on line %d", name, lineNumber+1))
+					break
+				}
+			}
+		}
+	}
+	return nil, fmt.Errorf("undefined template variable(s): %s", str.Join(missing, ", "))
+}
+
+//
+// Escape each ${NAME} in a task definition as $${NAME}, so that expandTemplate turns it back into ${NAME} instead of
+// filling it in. Used for output that's meant to be registered again, where a ${NAME} is the task definition's own,
+// such as a shell reference in a container's command.
+//
+func escapeTemplate(text string) string {
+	return templateReference.ReplaceAllStringFunc(text, func(reference string) string {
+		return "$" + reference
+	})
+}
+
+// Split a key=value assignment. The key can't be empty, but the value can.
+func splitAssignment(assignment string) (string, string, bool) {
+	pos := str.Index(assignment, "=")
+	if pos < 1 {
+		return "", "", false
+	}
+	return str.TrimSpace(assignment[:pos]), assignment[pos+1:], true
+}
@@ -6,24 +6,31 @@ Womply, www.womply.com
 package components
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
-	"os"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/private/protocol/json/jsonutil"
 	"github.com/aws/aws-sdk-go/service/ecs"
 )
 
+// Output formats for the read operations.
+const (
+	OutputText  = "text"
+	OutputJSON  = "json"
+	OutputTable = "table"
+)
+
 //
-// Utility function to check if an error is non-nil. Prints a helpful message and exits if so.
-// The helpful message is passed by the caller along with the error to check.
+// Print a value as an indented JSON document, for the read operations' machine-readable output.
 //
-func CheckError(action string, err error) {
+func PrintJSON(value interface{}) error {
+	jsonBytes, err := json.MarshalIndent(value, "", "  ")
 	if err != nil {
-		fmt.Println("Error", action, "==>", err)
-		os.Exit(1)
+		return fmt.Errorf("rendering output as JSON: %w", err)
 	}
+	fmt.Println(string(jsonBytes))
+	return nil
 }
 
 // Little utility function since we print separators in a few places.
@@ -31,10 +38,86 @@ func PrintSeparator() {
 	fmt.Println("-----------------------------------------------------------------------------------------------")
 }
 
-// Create a connection object for ECS service work.
-func GetEcsConnection(creds *credentials.Credentials, region string) *ecs.ECS {
-	return ecs.New(session.New(), &aws.Config{
-		Region:      aws.String(region),
-		Credentials: creds,
-	})
+//
+// Render a task definition as indented JSON, using the same field names as the ECS API and the AWS CLI's
+// --cli-input-json. Keys come out in a fixed order, so two renderings can be compared line by line.
+//
+func taskDefinitionJSON(input *ecs.RegisterTaskDefinitionInput) (string, error) {
+	compact, err := jsonutil.BuildJSON(input)
+	if err != nil {
+		return "", fmt.Errorf("rendering task definition as JSON: %w", err)
+	}
+	var indented bytes.Buffer
+	if err = json.Indent(&indented, compact, "", "  "); err != nil {
+		return "", fmt.Errorf("rendering task definition as JSON: %w", err)
+	}
+	return indented.String(), nil
+}
+
+//
+// Compare two texts line by line and return a unified-style diff: unchanged lines are prefixed with two spaces,
+// removed lines with "- " and added lines with "+ ". Only the given number of unchanged lines are kept around each
+// change, and skipped stretches are shown as "  ...". Returns nothing if the texts are the same.
+//
+func diffLines(before []string, after []string, context int) []string {
+	// common[i][j] is the length of the longest common subsequence of before[i:] and after[j:].
+	common := make([][]int, len(before)+1)
+	for i := range common {
+		common[i] = make([]int, len(after)+1)
+	}
+	for i := len(before) - 1; i >= 0; i-- {
+		for j := len(after) - 1; j >= 0; j-- {
+			if before[i] == after[j] {
+				common[i][j] = common[i+1][j+1] + 1
+			} else if common[i+1][j] >= common[i][j+1] {
+				common[i][j] = common[i+1][j]
+			} else {
+				common[i][j] = common[i][j+1]
+			}
+		}
+	}
+
+	var lines []string
+	var changed []bool
+	for i, j := 0, 0; i < len(before) || j < len(after); {
+		switch {
+		case i < len(before) && j < len(after) && before[i] == after[j]:
+			lines, changed = append(lines, "  "+before[i]), append(changed, false)
+			i++
+			j++
+		case i < len(before) && (j == len(after) || common[i+1][j] >= common[i][j+1]):
+			lines, changed = append(lines, "- "+before[i]), append(changed, true)
+			i++
+		default:
+			lines, changed = append(lines, "+ "+after[j]), append(changed, true)
+			j++
+		}
+	}
+
+	// Keep the changed lines and the context around them.
+	keep := make([]bool, len(lines))
+	var anyChange = false
+	for index := range lines {
+		if !changed[index] {
+			continue
+		}
+		anyChange = true
+		for k := index - context; k <= index+context; k++ {
+			if k >= 0 && k < len(lines) {
+				keep[k] = true
+			}
+		}
+	}
+	if !anyChange {
+		return nil
+	}
+	var diff []string
+	for index, line := range lines {
+		if keep[index] {
+			diff = append(diff, line)
+		} else if index == 0 || keep[index-1] {
+			diff = append(diff, "  ...")
+		}
+	}
+	return diff
 }
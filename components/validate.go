@@ -0,0 +1,365 @@
+/*
+Offline checks of task definition files, so mistakes can be caught before anything is registered.
+
+Womply, www.womply.com
+*/
+package components
+
+import str "strings"
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// The CPU units allowed for a Fargate task, mapped to the memory sizes in MiB each one allows.
+var fargateMemory = map[int64][]int64{
+	256:   {512, 1024, 2048},
+	512:   memoryRange(1024, 4096, 1024),
+	1024:  memoryRange(2048, 8192, 1024),
+	2048:  memoryRange(4096, 16384, 1024),
+	4096:  memoryRange(8192, 30720, 1024),
+	8192:  memoryRange(16384, 61440, 4096),
+	16384: memoryRange(32768, 122880, 8192),
+}
+
+// A docker image reference: an optional registry host and port, a lower-case repository path, an optional tag and an
+// optional digest. This follows the grammar docker uses for parsing references.
+var imageReference = regexp.MustCompile(`^` +
+	`(?:[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?(?:\.[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?)*(?::[0-9]+)?/)?` +
+	`[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*` +
+	`(?::[\w][\w.-]{0,127})?` +
+	`(?:@[A-Za-z][A-Za-z0-9]*(?:[-_+.][A-Za-z][A-Za-z0-9]*)*:[0-9a-fA-F]{32,})?$`)
+
+//
+// A problem found in a task definition file: the path of the field it's about, such as
+// "containerDefinitions[0].memory", and what's wrong with it.
+//
+type validationProblem struct {
+	path    string
+	message string
+}
+
+//
+// Check a task definition file without making any AWS calls, using the same loader as register, including its format
+// and template variables. Prints each problem found with the line and field it's about, and returns a ValidationError
+// if there are any.
+//
+func ValidateTaskFile(taskFile string, format string, vars map[string]string) error {
+	fileBytes, format, err := readTaskFile(taskFile, format, vars)
+	if err != nil {
+		return err
+	}
+	jsonBytes, err := taskFileJSON(fileBytes, format)
+	if err != nil {
+		// YAML errors already say which line they're on.
+		fmt.Printf("%s: %s\n", taskFile, err)
+		return &ValidationError{Message: fmt.Sprintf("%s can't be parsed", taskFile)}
+	}
+
+	taskDefinition, unknownKeys, err := parseTaskDefinition(jsonBytes)
+	if err != nil {
+		// The file can't be decoded at all, so point at where decoding stopped and give up.
+		switch decodeErr := err.(type) {
+		case *json.SyntaxError:
+			fmt.Printf("%s:%d: %s\n", taskFile, lineAtOffset(fileBytes, decodeErr.Offset), decodeErr)
+		case *json.UnmarshalTypeError:
+			// Offsets are into the JSON, which for YAML files isn't what the user wrote, so go by the field instead.
+			var line = lineAtOffset(fileBytes, decodeErr.Offset)
+			if format == formatYAML {
+				line = lineForPath(taskFileKeyLines(fileBytes, format), decodeErrorPath(decodeErr.Field))
+			}
+			fmt.Printf("%s:%d: %s: expected %s, got a %s\n", taskFile, line, decodeErr.Field, decodeErr.Type, decodeErr.Value)
+		default:
+			fmt.Printf("%s: %s\n", taskFile, err)
+		}
+		return &ValidationError{Message: fmt.Sprintf("%s can't be parsed", taskFile)}
+	}
+
+	var problems []validationProblem
+	for _, key := range unknownKeys {
+		problems = append(problems, validationProblem{key, "unknown key, not part of a task definition"})
+	}
+	problems = append(problems, checkTaskDefinition(taskDefinition)...)
+	if len(problems) == 0 {
+		fmt.Println(taskFile + ": OK")
+		return nil
+	}
+
+	// Print the problems in the order they appear in the file.
+	keyLines := taskFileKeyLines(fileBytes, format)
+	lines := make([]int, len(problems))
+	for index, problem := range problems {
+		lines[index] = lineForPath(keyLines, problem.path)
+	}
+	order := make([]int, len(problems))
+	for index := range order {
+		order[index] = index
+	}
+	sort.SliceStable(order, func(a, b int) bool { return lines[order[a]] < lines[order[b]] })
+	for _, index := range order {
+		fmt.Printf("%s:%d: %s: %s\n", taskFile, lines[index], problems[index].path, problems[index].message)
+	}
+	return &ValidationError{Message: fmt.Sprintf("%d problem(s) found in %s", len(problems), taskFile)}
+}
+
+/////////////// Private functions
+
+//
+// Run all of the checks on a parsed task definition and return the problems found.
+//
+func checkTaskDefinition(taskDefinition *ecs.RegisterTaskDefinitionInput) []validationProblem {
+	var problems []validationProblem
+	if taskDefinition.Family == nil || *taskDefinition.Family == "" {
+		problems = append(problems, validationProblem{"family", "required field is missing"})
+	}
+	if len(taskDefinition.ContainerDefinitions) == 0 {
+		problems = append(problems, validationProblem{"containerDefinitions", "at least one container definition is required"})
+	}
+
+	var fargate = false
+	for _, compatibility := range taskDefinition.RequiresCompatibilities {
+		if compatibility != nil && *compatibility == ecs.CompatibilityFargate {
+			fargate = true
+		}
+	}
+	if fargate {
+		problems = append(problems, checkFargateResources(taskDefinition)...)
+	}
+	var networkMode = ""
+	if taskDefinition.NetworkMode != nil {
+		networkMode = *taskDefinition.NetworkMode
+	}
+	if fargate && networkMode != ecs.NetworkModeAwsvpc {
+		problems = append(problems, validationProblem{"networkMode", "Fargate tasks must use the awsvpc network mode"})
+	}
+
+	var essential = false
+	names := map[string]bool{}
+	hostPorts := map[string]string{} // host port/protocol -> container using it
+	for containerIndex, container := range taskDefinition.ContainerDefinitions {
+		var path = fmt.Sprintf("containerDefinitions[%d]", containerIndex)
+		if container.Name == nil || *container.Name == "" {
+			problems = append(problems, validationProblem{path + ".name", "required field is missing"})
+		} else if names[*container.Name] {
+			problems = append(problems, validationProblem{path + ".name", fmt.Sprintf("duplicate container name %s", *container.Name)})
+		} else {
+			names[*container.Name] = true
+		}
+		if container.Image == nil || *container.Image == "" {
+			problems = append(problems, validationProblem{path + ".image", "required field is missing"})
+		} else if !imageReference.MatchString(*container.Image) {
+			problems = append(problems, validationProblem{path + ".image", fmt.Sprintf("%q is not a valid image reference", *container.Image)})
+		}
+		// Without a task-level memory size, EC2 tasks need one on every container.
+		if !fargate && taskDefinition.Memory == nil && container.Memory == nil && container.MemoryReservation == nil {
+			problems = append(problems, validationProblem{path + ".memory",
+				"memory or memoryReservation is required when the task doesn't set memory"})
+		}
+		if container.Essential == nil || *container.Essential {
+			essential = true
+		}
+
+		for portIndex, mapping := range container.PortMappings {
+			var portPath = fmt.Sprintf("%s.portMappings[%d]", path, portIndex)
+			if mapping.ContainerPort == nil {
+				problems = append(problems, validationProblem{portPath + ".containerPort", "required field is missing"})
+				continue
+			}
+			// In awsvpc and host modes the host port is always the container port.
+			var hostPort = int64(0)
+			if mapping.HostPort != nil {
+				hostPort = *mapping.HostPort
+			}
+			if networkMode == ecs.NetworkModeAwsvpc || networkMode == ecs.NetworkModeHost {
+				hostPort = *mapping.ContainerPort
+			}
+			if hostPort == 0 {
+				continue // A dynamic host port can't collide
+			}
+			var protocol = ecs.TransportProtocolTcp
+			if mapping.Protocol != nil {
+				protocol = *mapping.Protocol
+			}
+			var key = fmt.Sprintf("%d/%s", hostPort, protocol)
+			var containerName = fmt.Sprintf("#%d", containerIndex)
+			if container.Name != nil {
+				containerName = *container.Name
+			}
+			if other, taken := hostPorts[key]; taken {
+				problems = append(problems, validationProblem{portPath + ".hostPort",
+					fmt.Sprintf("host port %s is already used by container %s", key, other)})
+			} else {
+				hostPorts[key] = containerName
+			}
+		}
+	}
+	if len(taskDefinition.ContainerDefinitions) > 0 && !essential {
+		problems = append(problems, validationProblem{"containerDefinitions", "at least one container must be essential"})
+	}
+	for _, problem := range checkContainerDependencies(taskDefinition.ContainerDefinitions) {
+		problems = append(problems, validationProblem{"containerDefinitions", problem})
+	}
+	return problems
+}
+
+//
+// Fargate tasks need task-level CPU and memory, in one of the combinations Fargate supports.
+//
+func checkFargateResources(taskDefinition *ecs.RegisterTaskDefinitionInput) []validationProblem {
+	if taskDefinition.Cpu == nil || taskDefinition.Memory == nil {
+		return []validationProblem{{"requiresCompatibilities", "Fargate tasks must set both cpu and memory at the task level"}}
+	}
+	cpu, cpuOk := parseTaskSize(*taskDefinition.Cpu, "vcpu")
+	if !cpuOk {
+		return []validationProblem{{"cpu", fmt.Sprintf("can't read %q as CPU units or vCPU", *taskDefinition.Cpu)}}
+	}
+	memory, memoryOk := parseTaskSize(*taskDefinition.Memory, "gb")
+	if !memoryOk {
+		return []validationProblem{{"memory", fmt.Sprintf("can't read %q as MiB or GB", *taskDefinition.Memory)}}
+	}
+	allowed, found := fargateMemory[cpu]
+	if !found {
+		var sizes []int
+		for size := range fargateMemory {
+			sizes = append(sizes, int(size))
+		}
+		sort.Ints(sizes)
+		return []validationProblem{{"cpu", fmt.Sprintf("Fargate doesn't support %d CPU units, use one of %v", cpu, sizes)}}
+	}
+	for _, size := range allowed {
+		if size == memory {
+			return nil
+		}
+	}
+	return []validationProblem{{"memory", fmt.Sprintf("Fargate doesn't support %d MiB with %d CPU units, use %d to %d MiB",
+		memory, cpu, allowed[0], allowed[len(allowed)-1])}}
+}
+
+//
+// Read a task-level CPU or memory size, which is either a plain number of CPU units or MiB, or a number followed by
+// the given unit ("vcpu" or "gb"), which is worth 1024 of them. Returns false if the size can't be read.
+//
+func parseTaskSize(size string, unit string) (int64, bool) {
+	size = str.ToLower(str.TrimSpace(size))
+	if str.HasSuffix(size, unit) {
+		value, err := strconv.ParseFloat(str.TrimSpace(str.TrimSuffix(size, unit)), 64)
+		if err != nil {
+			return 0, false
+		}
+		return int64(value * 1024), true
+	}
+	value, err := strconv.ParseInt(size, 10, 64)
+	return value, err == nil
+}
+
+// Memory sizes from low to high in the given steps, inclusive.
+func memoryRange(low int64, high int64, step int64) []int64 {
+	var sizes []int64
+	for size := low; size <= high; size += step {
+		sizes = append(sizes, size)
+	}
+	return sizes
+}
+
+//
+// Map the path of each key and array element in a JSON document, such as "containerdefinitions[0].image", to the line
+// it's on. Paths are lower-cased, since keys are matched to fields without regard to case.
+//
+func jsonKeyLines(fileBytes []byte) map[string]int {
+	keyLines := map[string]int{}
+	decoder := json.NewDecoder(bytes.NewReader(fileBytes))
+	var walk func(path string) error
+	walk = func(path string) error {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		switch token {
+		case json.Delim('{'):
+			for decoder.More() {
+				key, err := decoder.Token()
+				if err != nil {
+					return err
+				}
+				var keyPath = fmt.Sprintf("%v", key)
+				if path != "" {
+					keyPath = path + "." + keyPath
+				}
+				keyLines[str.ToLower(keyPath)] = lineAtOffset(fileBytes, decoder.InputOffset())
+				if err := walk(keyPath); err != nil {
+					return err
+				}
+			}
+			_, err = decoder.Token()
+		case json.Delim('['):
+			for index := 0; decoder.More(); index++ {
+				var elementPath = fmt.Sprintf("%s[%d]", path, index)
+				// The element starts at the next thing that isn't a separator.
+				offset := decoder.InputOffset()
+				for offset < int64(len(fileBytes)) && str.ContainsRune(" \t\r\n,", rune(fileBytes[offset])) {
+					offset++
+				}
+				keyLines[str.ToLower(elementPath)] = lineAtOffset(fileBytes, offset+1)
+				if err := walk(elementPath); err != nil {
+					return err
+				}
+			}
+			_, err = decoder.Token()
+		}
+		return err
+	}
+	walk("")
+	return keyLines
+}
+
+//
+// Find the line for a field path. If the field isn't in the file, such as a missing required field, use the line of the
+// closest enclosing field that is. Returns 1 if nothing matches.
+//
+func lineForPath(keyLines map[string]int, path string) int {
+	path = str.ToLower(path)
+	for path != "" {
+		if line, found := keyLines[path]; found {
+			return line
+		}
+		cut := str.LastIndexAny(path, ".[")
+		if cut == -1 {
+			break
+		}
+		path = path[:cut]
+	}
+	return 1
+}
+
+// Turn the field of a decoding error, such as "containerDefinitions.0.memory", into a path like the ones keys are
+// mapped to lines by, such as "containerDefinitions[0].memory".
+func decodeErrorPath(field string) string {
+	var path = ""
+	for _, part := range str.Split(field, ".") {
+		if _, err := strconv.Atoi(part); err == nil {
+			path += "[" + part + "]"
+		} else if path == "" {
+			path = part
+		} else {
+			path += "." + part
+		}
+	}
+	return path
+}
+
+// The line number that a byte offset falls on, counting from 1. Offsets point just past the token they're about.
+func lineAtOffset(fileBytes []byte, offset int64) int {
+	if offset > int64(len(fileBytes)) {
+		offset = int64(len(fileBytes))
+	}
+	if offset > 0 {
+		offset-- // Look at the last byte of the token rather than the one after it
+	}
+	return bytes.Count(fileBytes[:offset], []byte("\n")) + 1
+}
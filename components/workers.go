@@ -0,0 +1,57 @@
+/*
+A bounded worker pool for fanning API calls out, so that listings of big clusters don't wait on one call at a time.
+
+Womply, www.womply.com
+*/
+package components
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// How many API calls are made at once unless the caller says otherwise.
+const DefaultConcurrency = 5
+
+/////////////// Private functions
+
+//
+// Call work once for every index from 0 to count-1, with at most concurrency calls running at the same time, and wait
+// for them all to finish. The calls can run in any order, so work should store its result by index to keep the output
+// in a fixed order. A concurrency below 1 runs one call at a time. Once a call fails no more are started, and the
+// error of the lowest failed index is returned.
+//
+func forEachConcurrently(count int, concurrency int, work func(index int) error) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if concurrency > count {
+		concurrency = count
+	}
+	errs := make([]error, count)
+	var failed int32
+	indexes := make(chan int)
+	var workers sync.WaitGroup
+	for worker := 0; worker < concurrency; worker++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for index := range indexes {
+				if errs[index] = work(index); errs[index] != nil {
+					atomic.StoreInt32(&failed, 1)
+				}
+			}
+		}()
+	}
+	for index := 0; index < count && atomic.LoadInt32(&failed) == 0; index++ {
+		indexes <- index
+	}
+	close(indexes)
+	workers.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
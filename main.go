@@ -5,16 +5,19 @@ Amazon Web Services' EC2 Container Service.
 To build the executables:
 
 Mac OS X: go build -o bin/ecsman.osx main.go
-Linux (with Docker running): docker run --rm -v "$PWD":/usr/src/ecsman -v ~/workspace/gowork/src/github.com:/go/src/github.com -w /usr/src/ecsman golang:1.8 go build -v
+Linux (with Docker running): docker run --rm -v "$PWD":/usr/src/ecsman -v ~/workspace/gowork/src/github.com:/go/src/github.com -w /usr/src/ecsman golang:1.13 go build -v
 
 Womply, www.womply.com
 */
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
+	"time"
 
 	"./components"
 
@@ -30,10 +33,18 @@ Usage:
 	ecsman ls == list clusters in the region
 	ecsman <options> ls clusterName == list services in the cluster
 	ecsman <options> ls clusterName serviceName == list service details
+	ecsman <options> rollback clusterName serviceName [revision] == point the service back at an earlier task definition revision
 	ecsman <options> check clusterName serviceName == check service tasks
+	ecsman <options> check clusterName == check every service in the cluster
+	ecsman <options> check -all == check every service in every cluster (-all can come before check too)
+	ecsman <options> stopped clusterName serviceName == list recently stopped tasks and why they stopped
 	ecsman <options> update clusterName serviceName imageURL == update the service with new image
+	ecsman <options> update clusterName serviceName containerName=imageURL ... == update one or more containers with new images
 	ecsman <options> taskdefs == list task definitions
-	ecsman <options> register taskFile == register a task using the specified JSON file
+	ecsman <options> register taskFile == register a task using the specified JSON or YAML file
+	ecsman <options> import-compose composeFile == convert a docker-compose file into a task definition
+	ecsman validate taskFile == check a task definition file without registering it
+	ecsman <options> export taskFamily:revision == print a task definition as JSON that register accepts
 	ecsman <options> run clusterName taskName == run a task
 */
 func main() {
@@ -42,9 +53,25 @@ func main() {
 	verboseFlag := flag.Bool("v", false, "Verbose printing with details")
 	versionFlag := flag.Bool("version", false, "Display version and exit")
 	regionFlag := flag.String("region", "us-west-2", "AWS region")
-	elbFlag := flag.Bool("elb", false, "Print ELB information")
+	elbFlag := flag.Bool("elb", false, "Print ELB and target group information")
 	credFlag := flag.String("cred", "", "AWS credential profile name (or use ECSCREDENTIAL env var)")
 	eventsFlag := flag.Int("events", 0, "List events for a service")
+	waitFlag := flag.Bool("wait", false, "Wait for an update to reach a steady state")
+	dryRunFlag := flag.Bool("dry-run", false, "Show what update would change without changing anything")
+	rollbackFlag := flag.Bool("rollback", false, "Wait for an update and roll it back if it fails (same as -wait)")
+	noRollbackFlag := flag.Bool("no-rollback", false, "Don't roll back an update that fails while waiting for it")
+	timeoutFlag := flag.Duration("timeout", 10*time.Minute, "How long -wait waits before giving up")
+	var varFlags assignmentList
+	flag.Var(&varFlags, "var", "Task file template variable as key=value (repeatable)")
+	varsFileFlag := flag.String("vars", "", "File of key=value task file template variables")
+	familyFlag := flag.String("family", "", "Task definition family for import-compose (default: the compose file's directory)")
+	registerFlag := flag.Bool("register", false, "Register the task definition from import-compose instead of printing it")
+	formatFlag := flag.String("format", "", "Task file format, json or yaml (default: by file extension)")
+	outputFlag := flag.String("o", components.OutputText, "Output format for ls, check, stopped and taskdefs: text, json or table")
+	retriesFlag := flag.Int("retries", components.DefaultMaxRetries, "How many times to retry throttled or failed AWS calls")
+	concurrencyFlag := flag.Int("concurrency", components.DefaultConcurrency, "How many API calls ls and check make at once")
+	allFlag := flag.Bool("all", false, "Check every service in every cluster")
+	sortFlag := flag.String("sort", "name", "Column to sort -o table listings by, prefixed with - to reverse")
 	flag.Usage = usage
 	flag.Parse()
 
@@ -59,6 +86,30 @@ func main() {
 		os.Exit(0)
 	}
 	var operation = flag.Arg(0)
+	if *retriesFlag < 0 {
+		usageMsg(fmt.Sprintf("-retries can't be negative, got %d", *retriesFlag))
+	}
+	if *concurrencyFlag < 1 {
+		usageMsg(fmt.Sprintf("-concurrency must be at least 1, got %d", *concurrencyFlag))
+	}
+	switch *outputFlag {
+	case components.OutputText, components.OutputJSON, components.OutputTable:
+	default:
+		usageMsg(fmt.Sprintf("Unknown output format: %s", *outputFlag))
+	}
+	// Anything extra printed would get in the way of the JSON document. Only ls has a table, the other read
+	// operations print text for -o table.
+	var textOutput = *outputFlag != components.OutputJSON
+	jsonErrors = !textOutput
+	// What check checks: a service, a cluster, or every cluster when checkClusters is nil.
+	var checkClusters []string
+	var checkServiceName string
+	if operation == "check" {
+		var checkErr error
+		if checkClusters, checkServiceName, checkErr = components.ParseCheckArguments(flag.Args()[1:], *allFlag); checkErr != nil {
+			usageMsg(checkErr.Error())
+		}
+	}
 
 	// What it calls "shared credentials" is the object that handles reading a user's credentials file from ~/.aws/credentials
 	// First, figure out whether we use a profile name passed in as a command-line argument, an environment variable,
@@ -76,60 +127,168 @@ func main() {
 	}
 	var creds *credentials.Credentials
 	if *credFlag == "env" {
-		if *verboseFlag {
+		if *verboseFlag && textOutput {
 			fmt.Printf("--> Running with credentials from environment variables\n\n")
 		}
 		creds = credentials.NewEnvCredentials()
 	} else {
-		if *verboseFlag {
+		if *verboseFlag && textOutput {
 			fmt.Printf("--> Running with credential profile %s\n\n", credProfile)
 		}
 		creds = credentials.NewSharedCredentials("", credProfile)
 	}
+	// One session and set of clients serves the whole run.
+	clients, err := components.NewClients(creds, *regionFlag, *retriesFlag, VERSION)
+	if err != nil && operation == "check" {
+		exitCheckUnknown(checkSubject(checkClusters, checkServiceName), err)
+	}
+	exitOnError(err)
 
 	// Okay, what do we want to do today?
 	switch {
 	case operation == "ls" && flag.NArg() < 2: // ls without a cluster name
-		components.ListClusters(creds, *regionFlag)
+		clusters, err := components.ListClusters(clients, *concurrencyFlag)
+		exitOnError(err)
+		switch *outputFlag {
+		case components.OutputJSON:
+			err = components.PrintJSON(clusters)
+		case components.OutputTable:
+			err = components.PrintClusterTable(clusters, *sortFlag)
+		default:
+			components.PrintClusters(clusters)
+		}
+		exitOnError(err)
 	case operation == "ls" && flag.NArg() > 1: // ls with cluster name and maybe service name
 		var serviceName = ""
 		if flag.NArg() > 2 {
 			serviceName = flag.Arg(2)
 		}
-		var loadBalancers []*string // Save from printServices in case user wants the ELB info printed too.
-		loadBalancers = components.PrintServices(creds, *regionFlag, flag.Arg(1), serviceName, *verboseFlag, *eventsFlag)
-		if *elbFlag {
-			components.PrintElbs(creds, *regionFlag, loadBalancers)
+		services, err := components.GetServices(clients, flag.Arg(1), serviceName, *eventsFlag, *concurrencyFlag)
+		exitOnError(err)
+		if *elbFlag { // Fetch the ELBs and target groups the services use if the user wants the ELB info too.
+			services.LoadBalancers, err = components.GetLoadBalancers(clients, services.LoadBalancerNames())
+			exitOnError(err)
+			services.TargetGroups, err = components.GetTargetGroups(clients, services.TargetGroupArns())
+			exitOnError(err)
+		}
+		switch *outputFlag {
+		case components.OutputJSON:
+			err = components.PrintJSON(services)
+		case components.OutputTable:
+			if err = components.PrintServiceTable(services, *sortFlag); err == nil {
+				components.PrintElbs(services.LoadBalancers)
+				components.PrintTargetGroups(services.TargetGroups)
+			}
+		default:
+			components.PrintServices(services, *verboseFlag)
+			components.PrintElbs(services.LoadBalancers)
+			components.PrintTargetGroups(services.TargetGroups)
 		}
+		exitOnError(err)
 	case operation == "register":
 		if flag.NArg() < 2 { // Make sure there's a task.JSON filename provided
-			usageMsg("Must specify JSON file describing the task to register.")
+			usageMsg("Must specify JSON or YAML file describing the task to register.")
+		}
+		vars, err := components.TemplateVars(*varsFileFlag, varFlags)
+		exitOnError(err)
+		_, err = components.CreateTask(clients, flag.Arg(1), *formatFlag, vars)
+		exitOnError(err)
+	case operation == "validate":
+		if flag.NArg() < 2 { // Make sure there's a task.JSON filename provided
+			usageMsg("Must specify JSON or YAML file describing the task to validate.")
+		}
+		vars, err := components.TemplateVars(*varsFileFlag, varFlags)
+		exitOnError(err)
+		exitOnError(components.ValidateTaskFile(flag.Arg(1), *formatFlag, vars))
+	case operation == "import-compose":
+		if flag.NArg() < 2 { // Make sure there's a compose filename provided
+			usageMsg("Must specify the docker-compose file to import.")
 		}
-		components.CreateTask(creds, *regionFlag, flag.Arg(1))
+		var family = *familyFlag
+		if family == "" { // Like compose's project name, default to the name of the directory the file is in
+			absPath, err := filepath.Abs(flag.Arg(1))
+			if err != nil {
+				usageMsg(fmt.Sprintf("Can't work out a family name for %s, use -family.", flag.Arg(1)))
+			}
+			family = filepath.Base(filepath.Dir(absPath))
+		}
+		exitOnError(components.ImportCompose(clients, flag.Arg(1), family, *registerFlag))
+	case operation == "export":
+		if flag.NArg() < 2 { // Make sure there's a task definition to export
+			usageMsg("Must specify the task definition to export, as family or family:revision.")
+		}
+		exitOnError(components.ExportTaskDefinition(clients, flag.Arg(1)))
 	case operation == "update":
-		if flag.NArg() < 4 { // Need cluster name, service name, and image URL
+		if flag.NArg() < 4 { // Need cluster name, service name, and at least one image URL
 			usageMsg("Must specify cluster name, service name, and image URL to update.")
 		}
-		components.UpdateService(creds, *regionFlag, flag.Arg(1), flag.Arg(2), flag.Arg(3))
+		if *rollbackFlag && *noRollbackFlag {
+			usageMsg("Can't use -rollback and -no-rollback together.")
+		}
+		var waitTimeout time.Duration // Zero means don't wait
+		if *waitFlag || *rollbackFlag {
+			waitTimeout = *timeoutFlag
+		}
+		// A failed update is rolled back unless asked not to. Without waiting there's no failure to roll back from.
+		var rollback = waitTimeout > 0 && !*noRollbackFlag
+		_, err := components.UpdateService(clients, flag.Arg(1), flag.Arg(2), flag.Args()[3:], waitTimeout, rollback, *dryRunFlag)
+		exitOnError(err)
+	case operation == "rollback":
+		if flag.NArg() < 3 { // Need cluster name and service name, revision is optional
+			usageMsg("Must specify cluster name and service name to roll back.")
+		}
+		var waitTimeout time.Duration // Zero means don't wait
+		if *waitFlag {
+			waitTimeout = *timeoutFlag
+		}
+		_, err := components.RollbackService(clients, flag.Arg(1), flag.Arg(2), flag.Arg(3), waitTimeout)
+		exitOnError(err)
+	case operation == "check" && checkServiceName == "": // Every service in a cluster, or in all of them
+		report, err := components.CheckClusters(clients, checkClusters, *concurrencyFlag)
+		if err != nil {
+			exitCheckUnknown(checkSubject(checkClusters, checkServiceName), err)
+		}
+		if textOutput {
+			components.PrintCheckReport(report, *verboseFlag)
+		} else if err = components.PrintJSON(report); err != nil {
+			exitCheckUnknown(checkSubject(checkClusters, checkServiceName), err)
+		}
+		os.Exit(int(report.Status))
 	case operation == "check":
+		check, err := components.CheckService(clients, checkClusters[0], checkServiceName)
+		if err != nil {
+			exitCheckUnknown(checkSubject(checkClusters, checkServiceName), err)
+		}
+		if textOutput {
+			components.PrintServiceCheck(check, *verboseFlag)
+		} else if err = components.PrintJSON(check); err != nil {
+			exitCheckUnknown(checkSubject(checkClusters, checkServiceName), err)
+		}
+		os.Exit(int(check.Status)) // The Nagios plugin exit codes: 0 OK, 1 WARNING, 2 CRITICAL
+	case operation == "stopped":
 		if flag.NArg() < 3 { // Need cluster name and service name
-			usageMsg("Must specify cluster name and service name to check.")
+			usageMsg("Must specify a cluster name and service name to list stopped tasks.")
+		}
+		stopped, err := components.GetStoppedTasks(clients, flag.Arg(1), flag.Arg(2))
+		exitOnError(err)
+		if textOutput {
+			components.PrintStoppedTasks(stopped)
+		} else {
+			exitOnError(components.PrintJSON(stopped))
 		}
-		components.CheckService(creds, *regionFlag, flag.Arg(1), flag.Arg(2), *verboseFlag)
 	case operation == "run":
 		if flag.NArg() < 3 { // Make sure there's a cluster name and  task name provided
 			usageMsg("Must specify a cluster name and the task name to run.")
 		}
-		components.RunTask(creds, *regionFlag, flag.Arg(1), flag.Arg(2))
+		exitOnError(components.RunTask(clients, flag.Arg(1), flag.Arg(2)))
 	case operation == "taskdefs":
-		if flag.NArg() < 2 {
-			components.PrintTasks(creds, *regionFlag, "", "")
+		// Family and revision are optional, and Arg() returns an empty string for missing ones.
+		taskDefinitions, err := components.ListTaskDefinitions(clients, flag.Arg(1), flag.Arg(2))
+		exitOnError(err)
+		if textOutput {
+			components.PrintTasks(taskDefinitions)
 		} else {
-			if flag.NArg() < 3 {
-				components.PrintTasks(creds, *regionFlag, flag.Arg(1), "")
-			} else {
-				components.PrintTasks(creds, *regionFlag, flag.Arg(1), flag.Arg(2))
-			}
+			exitOnError(components.PrintJSON(taskDefinitions))
 		}
 	case operation != "":
 		usageMsg(fmt.Sprintf("Unknown operation: %s", operation))
@@ -137,26 +296,121 @@ func main() {
 
 }
 
+// Exit codes for the kinds of error the components return. Usage errors exit with exitError too. The check operation
+// uses the Nagios plugin codes instead, and exits with UNKNOWN for any error.
+const (
+	exitError      = 1 // AWS API errors and anything else
+	exitValidation = 2 // Bad input, such as a task file with problems
+	exitNotFound   = 3 // A cluster, service, container or revision that doesn't exist
+	exitDeployment = 4 // A deployment that didn't reach a steady state
+)
+
+// Set for -o json, so that exitOnError also prints errors as a JSON document for scripts reading stdout.
+var jsonErrors = false
+
+//
+// Print an error to stderr and exit with the code for its kind. Does nothing if there's no error. With -o json, an
+// {"error": "..."} document is printed to stdout as well, so whatever reads the output still gets JSON. This is the
+// only place the program exits because of an error from the components.
+//
+func exitOnError(err error) {
+	if err == nil {
+		return
+	}
+	fmt.Fprintln(os.Stderr, "Error:", err)
+	if jsonErrors {
+		components.PrintJSON(map[string]string{"error": err.Error()})
+	}
+	var validationErr *components.ValidationError
+	var notFoundErr *components.NotFoundError
+	var deploymentErr *components.DeploymentError
+	switch {
+	case errors.As(err, &validationErr):
+		os.Exit(exitValidation)
+	case errors.As(err, &notFoundErr):
+		os.Exit(exitNotFound)
+	case errors.As(err, &deploymentErr):
+		os.Exit(exitDeployment)
+	}
+	os.Exit(exitError)
+}
+
+//
+// Print why a check couldn't be done, in the same one-line form as a check's summary, and exit with UNKNOWN. Monitoring
+// systems would read any other non-zero code as a problem with the service.
+//
+func exitCheckUnknown(subject string, err error) {
+	fmt.Printf("ECS %s - %s: %v\n", components.SeverityUnknown, subject, err)
+	os.Exit(int(components.SeverityUnknown))
+}
+
+// What the check operation is checking, as named in its summary: all clusters, a cluster, or cluster/service.
+func checkSubject(clusterNames []string, serviceName string) string {
+	switch {
+	case clusterNames == nil:
+		return "all clusters"
+	case serviceName == "":
+		return clusterNames[0]
+	}
+	return clusterNames[0] + "/" + serviceName
+}
+
 func usage() {
 	fmt.Println("Usage: ecsman <flags> <operation> <cluster> <service>")
-	fmt.Println("\n  Operations: ls, update, check, register, run, taskdefs")
+	fmt.Println("\n  Operations: ls, update, rollback, check, stopped, register, validate, import-compose, export, run, taskdefs")
 	fmt.Println("    ls: list. Cluster, service are optional to limit the listing.")
-	fmt.Println("    update: update a service. Requires cluster, service, image URL.")
-	fmt.Println("    check: check a service healt. Requires cluster, service.")
-	fmt.Println("    register: register a task definition. Requires task def JSON file path.")
+	fmt.Println("    update: update a service. Requires cluster, service, image URL (or container=imageURL per container).")
+	fmt.Println("    rollback: point a service at an earlier task definition revision. Requires cluster, service. Revision is optional.")
+	fmt.Println("    check: check a service's health. Requires cluster. Without a service, checks them all; -all checks every cluster.")
+	fmt.Println("           Exits 0 OK, 1 WARNING, 2 CRITICAL, 3 UNKNOWN.")
+	fmt.Println("    stopped: list a service's recently stopped tasks by reason, with exit codes. Requires cluster, service.")
+	fmt.Println("    register: register a task definition. Requires task def JSON or YAML file path.")
+	fmt.Println("    validate: check a task def file without registering it. Requires task def JSON or YAML file path.")
+	fmt.Println("    import-compose: convert a docker-compose file into a task definition. Requires compose file path.")
+	fmt.Println("    export: print a task definition as JSON that register accepts. Requires family or family:revision.")
 	fmt.Println("    run: run a task. Requires cluster and task name.")
 	fmt.Println("    taskdefs: list task definitions. Task family name and revision are optional. See documentation.")
 	fmt.Println("\n  Flags:")
 	fmt.Println("    -v                 For verbose listings with more details.")
-	fmt.Println("    -elb               List ELB information with cluster. Defaults to false.")
+	fmt.Println("    -elb               List ELB and target group information with cluster. Defaults to false.")
 	fmt.Println("    -events <int>      List <int> events for a service. Defaults to 0.")
+	fmt.Println("    -all               Check every service in every cluster. Use with check and no cluster name.")
+	fmt.Println("    -dry-run           Print the plan and task definition diff for update without changing anything.")
+	fmt.Println("    -wait              Wait for an update to reach a steady state, and roll it back if it fails. Exits non-zero if it fails.")
+	fmt.Println("    -rollback          The same as -wait.")
+	fmt.Println("    -no-rollback       With -wait, leave a failed update in place instead of rolling it back.")
+	fmt.Println("    -timeout <dur>     How long -wait waits, e.g. 5m or 90s. Defaults to 10m.")
+	fmt.Println("    -family <name>     Task definition family for import-compose. Defaults to the compose file's directory.")
+	fmt.Println("    -register          Register the task definition from import-compose instead of printing it.")
+	fmt.Println("    -format <format>   Task file format, json or yaml. Defaults to the file extension.")
+	fmt.Println("    -var <key=value>   Set a ${key} template variable in task files. Can be repeated.")
+	fmt.Println("    -vars <file>       Read task file template variables from a file of key=value lines.")
+	fmt.Println("    -o <format>        Output format for ls, check, stopped and taskdefs: text (default), json, or table for ls.")
+	fmt.Println("    -sort <column>     Column to sort -o table by, e.g. running or -last-event. Defaults to name.")
+	fmt.Println("    -concurrency <int> How many API calls ls and check make at once. Lower it to stay under the rate limit. Defaults to 5.")
 	fmt.Println("    -cred <profile>    AWS credential profile name (or use ECSCREDENTIAL env var)")
 	fmt.Println("    -region <region>   AWS region, defaults to us-west-2")
+	fmt.Println("    -retries <int>     How many times to retry throttled or failed AWS calls, with backoff. Defaults to 8.")
 	fmt.Println("    -version           Print program version and exit.")
 }
 
+// Collects the values of a flag that can be given more than once, such as -var.
+type assignmentList []string
+
+func (list *assignmentList) String() string {
+	return fmt.Sprint(*list)
+}
+
+func (list *assignmentList) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
+
 func usageMsg(msg string) {
 	fmt.Println(msg)
 	usage()
+	if flag.Arg(0) == "check" { // A misconfigured check is UNKNOWN, not WARNING
+		os.Exit(int(components.SeverityUnknown))
+	}
 	os.Exit(1)
 }